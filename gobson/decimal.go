@@ -0,0 +1,244 @@
+// gobson - BSON library for Go.
+// 
+// Copyright (c) 2010-2011 - Gustavo Niemeyer <gustavo@niemeyer.net>
+// 
+// All rights reserved.
+// 
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// 
+//     * Redistributions of source code must retain the above copyright notice,
+//       this list of conditions and the following disclaimer.
+//     * Redistributions in binary form must reproduce the above copyright notice,
+//       this list of conditions and the following disclaimer in the documentation
+//       and/or other materials provided with the distribution.
+//     * Neither the name of the copyright holder nor the names of its
+//       contributors may be used to endorse or promote products derived from
+//       this software without specific prior written permission.
+// 
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+
+package bson
+
+import (
+	"strconv"
+	"strings"
+	"os"
+)
+
+// Decimal128 holds a 128-bit decimal floating point value, as defined by
+// the IEEE 754-2008 standard using the binary integer decimal (BID)
+// encoding, which MongoDB supports since version 3.4.  It should be used
+// for values which must be represented exactly, such as monetary amounts,
+// and is marshalled as the BSON decimal type.
+//
+// Relevant documentation:
+//
+//     https://github.com/mongodb/specifications/blob/master/source/bson-decimal128/decimal128.rst
+//
+type Decimal128 struct {
+	h, l uint64
+}
+
+const (
+	decimalMinExp  = -6176
+	decimalMaxExp  = 6111
+	decimalBias    = 6176
+	decimalMaxLen  = 34
+	decimalSign    = 1 << 63
+	decimalNaN     = 0x7C00000000000000
+	decimalInf     = 0x7800000000000000
+	decimalMaxHigh = 0x0001ED09BEAD87C0 // High bits of 10^34 - 1.
+	decimalMaxLow  = 0x378D8E63FFFFFFFF // Low bits of 10^34 - 1.
+)
+
+// ParseDecimal128 parses s as a decimal value, such as "-1.50",
+// "1.5E-3", "Infinity" or "NaN", and returns it as a Decimal128.
+// The number of significant digits and the exponent are preserved, so
+// "1.50" and "1.5" result in distinct values that compare as equal in
+// MongoDB.  An error is returned if s is not a valid decimal value, or
+// if it can't be represented exactly with the 34 digits and the exponent
+// range of the Decimal128 format.
+func ParseDecimal128(s string) (Decimal128, os.Error) {
+	orig := s
+	bad := func(reason string) (Decimal128, os.Error) {
+		return Decimal128{}, os.NewError("Can't parse " + strconv.Quote(orig) + " as a decimal: " + reason)
+	}
+	var sign uint64
+	if s != "" && (s[0] == '-' || s[0] == '+') {
+		if s[0] == '-' {
+			sign = decimalSign
+		}
+		s = s[1:]
+	}
+	switch strings.ToLower(s) {
+	case "nan":
+		return Decimal128{sign | decimalNaN, 0}, nil
+	case "inf", "infinity":
+		return Decimal128{sign | decimalInf, 0}, nil
+	}
+
+	var digits []byte
+	var exp int
+	var dot, digit bool
+	i := 0
+	for ; i < len(s); i++ {
+		c := s[i]
+		if c == '.' {
+			if dot {
+				return bad("unexpected dot")
+			}
+			dot = true
+			continue
+		}
+		if c < '0' || c > '9' {
+			break
+		}
+		digit = true
+		if dot {
+			exp--
+		}
+		if c != '0' || len(digits) > 0 {
+			digits = append(digits, c)
+		}
+	}
+	if !digit {
+		return bad("no digits")
+	}
+	if i < len(s) {
+		if s[i] != 'e' && s[i] != 'E' {
+			return bad("unexpected character " + strconv.Quote(s[i:i+1]))
+		}
+		e, err := strconv.Atoi(s[i+1:])
+		if err != nil {
+			return bad("invalid exponent")
+		}
+		exp += e
+	}
+
+	if len(digits) == 0 {
+		// Zero may be represented with any exponent in range.
+		if exp < decimalMinExp {
+			exp = decimalMinExp
+		} else if exp > decimalMaxExp {
+			exp = decimalMaxExp
+		}
+	}
+	// Drop trailing zeros or add them as necessary, as long as the
+	// value doesn't change.
+	for len(digits) > 0 && digits[len(digits)-1] == '0' &&
+		(exp < decimalMinExp || len(digits) > decimalMaxLen) && exp < decimalMaxExp {
+		digits = digits[:len(digits)-1]
+		exp++
+	}
+	for len(digits) > 0 && len(digits) < decimalMaxLen && exp > decimalMaxExp {
+		digits = append(digits, '0')
+		exp--
+	}
+	if len(digits) > decimalMaxLen {
+		return bad("too many significant digits")
+	}
+	if exp < decimalMinExp || exp > decimalMaxExp {
+		return bad("exponent out of range")
+	}
+
+	var h, l uint64
+	for _, c := range digits {
+		h, l = mul10add(h, l, uint64(c-'0'))
+	}
+	h |= sign | uint64(exp+decimalBias)<<49
+	return Decimal128{h, l}, nil
+}
+
+// String returns the decimal value in its canonical string form, which
+// uses scientific notation only for large exponents or very small values.
+func (d Decimal128) String() string {
+	var sign string
+	if d.h&decimalSign != 0 {
+		sign = "-"
+	}
+	switch d.h >> 58 & 0x1F {
+	case 0x1F:
+		return "NaN"
+	case 0x1E:
+		return sign + "Infinity"
+	}
+
+	var exp int
+	var h, l uint64
+	if d.h>>61&3 == 3 {
+		// The significand would be larger than 10^34 - 1, so the
+		// value is non-canonical and must be interpreted as zero.
+		exp = int(d.h>>47&(1<<14-1)) - decimalBias
+	} else {
+		exp = int(d.h>>49&(1<<14-1)) - decimalBias
+		h, l = d.h&(1<<49-1), d.l
+		if h > decimalMaxHigh || h == decimalMaxHigh && l > decimalMaxLow {
+			h, l = 0, 0
+		}
+	}
+
+	var buf [40]byte
+	i := len(buf)
+	for {
+		var rem uint64
+		h, l, rem = divmod1e9(h, l)
+		for j := 0; j < 9; j++ {
+			i--
+			buf[i] = byte('0' + rem%10)
+			rem /= 10
+		}
+		if h == 0 && l == 0 {
+			break
+		}
+	}
+	for i < len(buf)-1 && buf[i] == '0' {
+		i++
+	}
+	digits := string(buf[i:])
+	n := len(digits)
+
+	adjusted := exp + n - 1
+	switch {
+	case exp > 0 || adjusted < -6:
+		s := digits[:1]
+		if n > 1 {
+			s += "." + digits[1:]
+		}
+		if adjusted >= 0 {
+			return sign + s + "E+" + strconv.Itoa(adjusted)
+		}
+		return sign + s + "E" + strconv.Itoa(adjusted)
+	case exp == 0:
+		return sign + digits
+	case n > -exp:
+		return sign + digits[:n+exp] + "." + digits[n+exp:]
+	}
+	return sign + "0." + strings.Repeat("0", -exp-n) + digits
+}
+
+// mul10add returns the 128-bit value h:l multiplied by 10 plus d.
+func mul10add(h, l, d uint64) (uint64, uint64) {
+	lo := (l&(1<<32-1))*10 + d
+	hi := (l>>32)*10 + lo>>32
+	return h*10 + hi>>32, hi<<32 | lo&(1<<32-1)
+}
+
+// divmod1e9 returns the 128-bit value h:l divided by 10^9, and the
+// remainder of the division.
+func divmod1e9(h, l uint64) (qh, ql, rem uint64) {
+	const div = 1e9
+	q3, r := (h>>32)/div, (h>>32)%div
+	q2, r := (r<<32|h&(1<<32-1))/div, (r<<32|h&(1<<32-1))%div
+	q1, r := (r<<32|l>>32)/div, (r<<32|l>>32)%div
+	q0, r := (r<<32|l&(1<<32-1))/div, (r<<32|l&(1<<32-1))%div
+	return q3<<32 | q2, q1<<32 | q0, r
+}
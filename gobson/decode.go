@@ -388,6 +388,8 @@ func (d *decoder) readElemTo(out reflect.Value, kind byte) (good bool) {
 		in = MongoTimestamp(d.readInt64())
 	case '\x12': // Int64
 		in = d.readInt64()
+	case '\x13': // Decimal128
+		in = d.readDecimal128()
 	case '\x7F': // Max key
 		in = MaxKey
 	case '\xFF': // Min key
@@ -464,6 +466,11 @@ func (d *decoder) readElemTo(out reflect.Value, kind byte) (good bool) {
 				out.SetString(string(b))
 				return true
 			}
+		case reflect.Struct:
+			if dec, ok := in.(Decimal128); ok {
+				out.SetString(dec.String())
+				return true
+			}
 		}
 	case reflect.Slice, reflect.Array:
 		// Remember, array (0x04) slices are built with the correct element
@@ -570,6 +577,12 @@ func (d *decoder) readRegEx() RegEx {
 	return re
 }
 
+func (d *decoder) readDecimal128() Decimal128 {
+	l := uint64(d.readInt64())
+	h := uint64(d.readInt64())
+	return Decimal128{h, l}
+}
+
 func (d *decoder) readBinary() Binary {
 	l := d.readInt32()
 	b := Binary{}
@@ -584,6 +597,9 @@ func (d *decoder) readBinary() Binary {
 
 func (d *decoder) readStr() string {
 	l := d.readInt32()
+	if l < 1 {
+		corrupted()
+	}
 	b := d.readBytes(l - 1)
 	if d.readByte() != '\x00' {
 		corrupted()
@@ -648,6 +664,9 @@ func (d *decoder) readByte() byte {
 }
 
 func (d *decoder) readBytes(length int32) []byte {
+	if length < 0 {
+		corrupted()
+	}
 	start := d.i
 	d.i += int(length)
 	if d.i > len(d.in) {
@@ -339,6 +339,11 @@ func (e *encoder) addElem(name string, v reflect.Value, minSize bool) {
 			e.addElemName('\x05', name)
 			e.addBinary(s.Kind, s.Data)
 
+		case Decimal128:
+			e.addElemName('\x13', name)
+			e.addInt64(int64(s.l))
+			e.addInt64(int64(s.h))
+
 		case RegEx:
 			e.addElemName('\x0B', name)
 			e.addCStr(s.Pattern)
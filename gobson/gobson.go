@@ -426,6 +426,7 @@ func Marshal(in interface{}) (out []byte, err os.Error) {
 // - Bools are converted to numeric types as 1 or 0
 // - Numeric types are converted to bools as true if not 0 or false otherwise
 // - Binary and string BSON data is converted to a string, array or byte slice
+// - Decimal128 values are converted to a string in their canonical form
 //
 // If the value would not fit the type and cannot be converted, it's silently
 // skipped.
@@ -33,7 +33,12 @@ package bson_test
 import (
 	. "launchpad.net/gocheck"
 	"encoding/binary"
+	"encoding/hex"
+	"bytes"
 	"json"
+	"io"
+	"strconv"
+	"strings"
 	"testing"
 	"reflect"
 	"time"
@@ -1200,3 +1205,456 @@ func (s *S) TestObjectIdJSONUnmarshalingError(c *C) {
 	err = json.Unmarshal([]byte(`{"Id":"4d88e15b60f486e428412dcZ"}`), &v)
 	c.Assert(err, Matches, `Invalid ObjectId in JSON: "4d88e15b60f486e428412dcZ" \(invalid hex char: 90\)`)
 }
+
+// --------------------------------------------------------------------------
+// Extended JSON.
+
+var extJSONDoc = bson.D{
+	{"_id", bson.ObjectIdHex("4d88e15b60f486e428412dc9")},
+	{"f", 1.5},
+	{"fi", 2.0},
+	{"s", "a\"b\n"},
+	{"d", bson.D{{"x", 1}}},
+	{"a", []interface{}{1, "two"}},
+	{"bin", []byte("hello")},
+	{"uuid", bson.Binary{0x04, []byte{1, 2, 3}}},
+	{"t", bson.Timestamp(1356351330501 * 1e6)},
+	{"null", nil},
+	{"re", bson.RegEx{"^a", "i"}},
+	{"code", bson.JS{Code: "f()"}},
+	{"scope", bson.JS{"g(x)", bson.D{{"x", 1}}}},
+	{"sym", bson.Symbol("sym")},
+	{"i32", 42},
+	{"ts", bson.MongoTimestamp(5<<32 | 7)},
+	{"i64", int64(1) << 40},
+	{"true", true},
+	{"min", bson.MinKey},
+	{"max", bson.MaxKey},
+	{"undef", bson.Undefined},
+}
+
+var extJSONCanonical = `{"_id":{"$oid":"4d88e15b60f486e428412dc9"},` +
+	`"f":{"$numberDouble":"1.5"},"fi":{"$numberDouble":"2.0"},"s":"a\"b\n",` +
+	`"d":{"x":{"$numberInt":"1"}},"a":[{"$numberInt":"1"},"two"],` +
+	`"bin":{"$binary":{"base64":"aGVsbG8=","subType":"00"}},` +
+	`"uuid":{"$binary":{"base64":"AQID","subType":"04"}},` +
+	`"t":{"$date":{"$numberLong":"1356351330501"}},"null":null,` +
+	`"re":{"$regularExpression":{"pattern":"^a","options":"i"}},` +
+	`"code":{"$code":"f()"},"scope":{"$code":"g(x)","$scope":{"x":{"$numberInt":"1"}}},` +
+	`"sym":{"$symbol":"sym"},"i32":{"$numberInt":"42"},"ts":{"$timestamp":{"t":5,"i":7}},` +
+	`"i64":{"$numberLong":"1099511627776"},"true":true,` +
+	`"min":{"$minKey":1},"max":{"$maxKey":1},"undef":{"$undefined":true}}`
+
+var extJSONRelaxed = `{"_id":{"$oid":"4d88e15b60f486e428412dc9"},` +
+	`"f":1.5,"fi":2.0,"s":"a\"b\n",` +
+	`"d":{"x":1},"a":[1,"two"],` +
+	`"bin":{"$binary":{"base64":"aGVsbG8=","subType":"00"}},` +
+	`"uuid":{"$binary":{"base64":"AQID","subType":"04"}},` +
+	`"t":{"$date":"2012-12-24T12:15:30.501Z"},"null":null,` +
+	`"re":{"$regularExpression":{"pattern":"^a","options":"i"}},` +
+	`"code":{"$code":"f()"},"scope":{"$code":"g(x)","$scope":{"x":1}},` +
+	`"sym":{"$symbol":"sym"},"i32":42,"ts":{"$timestamp":{"t":5,"i":7}},` +
+	`"i64":1099511627776,"true":true,` +
+	`"min":{"$minKey":1},"max":{"$maxKey":1},"undef":{"$undefined":true}}`
+
+func (s *S) TestMarshalExtJSON(c *C) {
+	data, err := bson.MarshalExtJSON(extJSONDoc, true)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, extJSONCanonical)
+
+	data, err = bson.MarshalExtJSON(extJSONDoc, false)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, extJSONRelaxed)
+
+	data, err = bson.MarshalExtJSON(bson.M{"x": int64(-1)}, true)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, `{"x":{"$numberLong":"-1"}}`)
+
+	data, err = bson.MarshalExtJSON(bson.M{"t": bson.Timestamp(-1e6)}, false)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, `{"t":{"$date":{"$numberLong":"-1"}}}`)
+
+	raw := bson.Raw{0x07, []byte(string(bson.ObjectIdHex("4d88e15b60f486e428412dc9")))}
+	data, err = bson.MarshalExtJSON(raw, true)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, `{"$oid":"4d88e15b60f486e428412dc9"}`)
+
+	raw = bson.Raw{0x10, []byte{1, 0, 0, 0}}
+	data, err = bson.MarshalExtJSON(raw, false)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, `1`)
+
+	_, err = bson.MarshalExtJSON(bson.Raw{0x03, []byte{5, 0, 0}}, false)
+	c.Assert(err, Matches, "Document is corrupted")
+}
+
+func (s *S) TestExtJSONRoundTrip(c *C) {
+	expected, err := bson.Marshal(extJSONDoc)
+	c.Assert(err, IsNil)
+
+	for _, data := range []string{extJSONCanonical, extJSONRelaxed} {
+		var raw bson.Raw
+		err := bson.UnmarshalExtJSON([]byte(data), &raw)
+		c.Assert(err, IsNil)
+		c.Assert(raw.Kind, Equals, byte(0x03))
+		c.Assert(string(raw.Data), Equals, string(expected))
+
+		out, err := bson.MarshalExtJSON(raw, data == extJSONCanonical)
+		c.Assert(err, IsNil)
+		c.Assert(string(out), Equals, data)
+	}
+}
+
+func (s *S) TestUnmarshalExtJSON(c *C) {
+	data := `{"re": {"$regex": "^a", "$options": "i"}, "q": {"$regex": "^b"},
+		"bin": {"$binary": "AQID", "$type": "04"}, "t": {"$date": 1000},
+		"iso": {"$date": "2012-12-24T14:15:30.5+02:00"},
+		"n": 1, "l": 4294967296, "f": 1e3, "s": "é😀\/",
+		"inf": {"$numberDouble": "-Infinity"}, "e": {}, "ea": []}`
+	m := bson.M{}
+	err := bson.UnmarshalExtJSON([]byte(data), m)
+	c.Assert(err, IsNil)
+	c.Assert(m["re"], Equals, bson.RegEx{"^a", "i"})
+	c.Assert(m["q"], Equals, bson.M{"$regex": "^b"})
+	c.Assert(m["bin"], Equals, bson.Binary{0x04, []byte{1, 2, 3}})
+	c.Assert(m["t"], Equals, bson.Timestamp(1e9))
+	c.Assert(m["iso"], Equals, bson.Timestamp(1356351330500*1e6))
+	c.Assert(m["n"], Equals, 1)
+	c.Assert(m["l"], Equals, int64(4294967296))
+	c.Assert(m["f"], Equals, 1000.0)
+	c.Assert(m["s"], Equals, "é\U0001F600/")
+	c.Assert(m["inf"].(float64) < -1e308, Equals, true)
+	c.Assert(m["e"], Equals, bson.M{})
+	c.Assert(m["ea"], Equals, []interface{}{})
+
+	var d bson.D
+	err = bson.UnmarshalExtJSON([]byte(`{"b": 1, "a": {"$numberLong": "2"}}`), &d)
+	c.Assert(err, IsNil)
+	c.Assert(d, Equals, bson.D{{"b", 1}, {"a", int64(2)}})
+
+	var v struct {
+		Id bson.ObjectId "_id"
+		N  int64
+	}
+	err = bson.UnmarshalExtJSON([]byte(`{"_id": {"$oid": "4d88e15b60f486e428412dc9"}, "n": 3}`), &v)
+	c.Assert(err, IsNil)
+	c.Assert(v.Id, Equals, bson.ObjectIdHex("4d88e15b60f486e428412dc9"))
+	c.Assert(v.N, Equals, int64(3))
+}
+
+var extJSONErrorItems = []struct {
+	data  string
+	error string
+}{
+	{`{"a": }`, `Invalid extended JSON at offset 6: unexpected character '}'`},
+	{`{"a": 1`, `Invalid extended JSON at offset 7: expected '}'`},
+	{`{"a": "b}`, `Invalid extended JSON at offset 9: unterminated string`},
+	{`{"a": 1} x`, `Invalid extended JSON at offset 9: unexpected data after the document`},
+	{`[1]`, `Invalid extended JSON at offset 0: expected a document`},
+	{`{"$oid": "4d88e15b60f486e428412dc9"}`, `Extended JSON value is not a document`},
+	{`{"a": {"$oid": "xyz"}}`, `Invalid extended JSON \$oid value`},
+	{`{"a": {"$numberInt": "2147483648"}}`, `Invalid extended JSON \$numberInt value`},
+	{`{"a": {"$date": "yesterday"}}`, `Invalid extended JSON \$date value`},
+	{`{"a": {"$timestamp": {"t": -1, "i": 0}}}`, `Invalid extended JSON \$timestamp value`},
+	{`{"a": {"$binary": {"base64": "AQID", "subType": "x"}}}`, `Invalid extended JSON binary subtype: x`},
+}
+
+func (s *S) TestUnmarshalExtJSONErrors(c *C) {
+	for _, item := range extJSONErrorItems {
+		err := bson.UnmarshalExtJSON([]byte(item.data), bson.M{})
+		c.Assert(err, Matches, item.error, Bug("Data: %s", item.data))
+	}
+}
+
+// --------------------------------------------------------------------------
+// Streaming of documents.
+
+func (s *S) TestEncoderDecoder(c *C) {
+	var buf bytes.Buffer
+	enc := bson.NewEncoder(&buf)
+	err := enc.Encode(bson.M{"a": 1})
+	c.Assert(err, IsNil)
+	err = enc.Encode(bson.D{{"b", string(make([]byte, 1000))}})
+	c.Assert(err, IsNil)
+	err = enc.Encode(&struct{ C bool }{true})
+	c.Assert(err, IsNil)
+
+	data1, _ := bson.Marshal(bson.M{"a": 1})
+	data3, _ := bson.Marshal(bson.M{"c": true})
+	c.Assert(buf.Len(), Equals, len(data1)+1013+len(data3))
+
+	dec := bson.NewDecoder(&buf)
+	m := bson.M{}
+	err = dec.Decode(m)
+	c.Assert(err, IsNil)
+	c.Assert(m, Equals, bson.M{"a": 1})
+
+	var v struct{ B string }
+	err = dec.Decode(&v)
+	c.Assert(err, IsNil)
+	c.Assert(len(v.B), Equals, 1000)
+
+	raw, err := dec.DecodeRaw()
+	c.Assert(err, IsNil)
+	c.Assert(raw.Kind, Equals, byte(0x03))
+	c.Assert(string(raw.Data), Equals, string(data3))
+
+	err = dec.Decode(m)
+	c.Assert(err, Equals, os.EOF)
+}
+
+func (s *S) TestEncoderError(c *C) {
+	var buf bytes.Buffer
+	enc := bson.NewEncoder(&buf)
+	err := enc.Encode(123)
+	c.Assert(err, Matches, "Can't marshal int as a BSON document")
+	c.Assert(buf.Len(), Equals, 0)
+}
+
+func (s *S) TestDecoderTruncated(c *C) {
+	data, _ := bson.Marshal(bson.M{"a": 1})
+	for _, n := range []int{2, len(data) - 1} {
+		dec := bson.NewDecoder(bytes.NewBuffer(data[:n]))
+		err := dec.Decode(bson.M{})
+		c.Assert(err, Equals, io.ErrUnexpectedEOF)
+	}
+}
+
+func (s *S) TestDecoderMaxSize(c *C) {
+	data, _ := bson.Marshal(bson.M{"a": "hello world"})
+	dec := bson.NewDecoder(bytes.NewBuffer(data))
+	dec.SetMaxSize(len(data) - 1)
+	err := dec.Decode(bson.M{})
+	c.Assert(err, Matches, "BSON document size 24 exceeds the maximum of 23")
+
+	dec = bson.NewDecoder(bytes.NewBuffer([]byte{4, 0, 0, 0, 0}))
+	err = dec.Decode(bson.M{})
+	c.Assert(err, Matches, "Invalid BSON document size: 4")
+
+	dec = bson.NewDecoder(bytes.NewBuffer([]byte{0, 0, 0, 0x80}))
+	err = dec.Decode(bson.M{})
+	c.Assert(err, Matches, "Invalid BSON document size: -2147483648")
+}
+
+// --------------------------------------------------------------------------
+// Raw document inspection.
+
+func rawDocument(c *C) bson.RawDocument {
+	data, err := bson.Marshal(bson.D{
+		{"_id", bson.ObjectIdHex("4d88e15b60f486e428412dc9")},
+		{"a", bson.D{{"b", []interface{}{bson.D{{"c", "x"}}, 2}}}},
+		{"$err", "boom"},
+	})
+	c.Assert(err, IsNil)
+	return bson.RawDocument(data)
+}
+
+func (s *S) TestRawDocumentValidate(c *C) {
+	doc := rawDocument(c)
+	c.Assert(doc.Validate(), IsNil)
+
+	err := doc[:len(doc)-1].Validate()
+	c.Assert(err, Matches, "Document is corrupted")
+
+	err = append(doc, 0).Validate()
+	c.Assert(err, Matches, "Document is corrupted")
+
+	// Break the terminator of the "c" string.
+	bad := append(bson.RawDocument(nil), doc...)
+	bad[len(doc)-27] = 'y'
+	err = bad.Validate()
+	c.Assert(err, Matches, "Document is corrupted")
+
+	// Zero and negative lengths for the "$err" string.
+	for _, l := range [][]byte{{0, 0, 0, 0}, {0xff, 0xff, 0xff, 0xff}} {
+		bad = append(bson.RawDocument(nil), doc...)
+		copy(bad[len(doc)-10:], l)
+		err = bad.Validate()
+		c.Assert(err, Matches, "Document is corrupted")
+	}
+}
+
+func (s *S) TestRawDocumentElements(c *C) {
+	doc := rawDocument(c)
+	elems, err := doc.Elements()
+	c.Assert(err, IsNil)
+	c.Assert(len(elems), Equals, 3)
+	c.Assert(elems[0].Name, Equals, "_id")
+	c.Assert(elems[0].Value.Kind, Equals, byte(0x07))
+	c.Assert(string(elems[0].Value.Data), Equals, string(bson.ObjectIdHex("4d88e15b60f486e428412dc9")))
+	c.Assert(elems[1].Name, Equals, "a")
+	c.Assert(elems[1].Value.Kind, Equals, byte(0x03))
+	c.Assert(elems[2].Name, Equals, "$err")
+	c.Assert(elems[2].Value.Kind, Equals, byte(0x02))
+
+	var a bson.M
+	err = elems[1].Value.Unmarshal(&a)
+	c.Assert(err, IsNil)
+	c.Assert(a, Equals, bson.M{"b": []interface{}{bson.M{"c": "x"}, 2}})
+
+	_, err = doc[:len(doc)-1].Elements()
+	c.Assert(err, Matches, "Document is corrupted")
+}
+
+func (s *S) TestRawDocumentLookup(c *C) {
+	doc := rawDocument(c)
+
+	value, err := doc.Lookup("_id")
+	c.Assert(err, IsNil)
+	var id bson.ObjectId
+	c.Assert(value.Unmarshal(&id), IsNil)
+	c.Assert(id, Equals, bson.ObjectIdHex("4d88e15b60f486e428412dc9"))
+
+	value, err = doc.Lookup("a.b.0.c")
+	c.Assert(err, IsNil)
+	c.Assert(value.Kind, Equals, byte(0x02))
+	var str string
+	c.Assert(value.Unmarshal(&str), IsNil)
+	c.Assert(str, Equals, "x")
+
+	value, err = doc.Lookup("a.b.1")
+	c.Assert(err, IsNil)
+	c.Assert(value.Kind, Equals, byte(0x10))
+	c.Assert(value.Data, Equals, []byte{2, 0, 0, 0})
+
+	value, err = doc.Lookup("a.b")
+	c.Assert(err, IsNil)
+	c.Assert(value.Kind, Equals, byte(0x04))
+
+	for _, path := range []string{"b", "a.c", "a.b.2", "_id.x", "a.b.0.c.d", ""} {
+		_, err = doc.Lookup(path)
+		c.Assert(err, Equals, bson.ElemNotFound, Bug("Path: %q", path))
+	}
+
+	// Elements after the one found aren't verified.
+	bad := append(bson.RawDocument(nil), doc...)
+	bad[len(doc)-2] = 'x'
+	_, err = bad.Lookup("_id")
+	c.Assert(err, IsNil)
+	_, err = bad.Lookup("$err")
+	c.Assert(err, Matches, "Document is corrupted")
+	c.Assert(bad.Validate(), Matches, "Document is corrupted")
+}
+
+// --------------------------------------------------------------------------
+// Decimal128 values, following the format of the BSON corpus tests.
+
+var decimalItems = []struct {
+	bson   string // Hex encoding of {"d": <value>}.
+	string string
+}{
+	{"180000001364000000000000000000000000000000403000", "0"},
+	{"18000000136400000000000000000000000000000040B000", "-0"},
+	{"180000001364000100000000000000000000000000403000", "1"},
+	{"18000000136400010000000000000000000000000040B000", "-1"},
+	{"18000000136400640000000000000000000000000040B000", "-100"},
+	{"1800000013640001000000000000000000000000003E3000", "0.1"},
+	{"18000000136400D204000000000000000000000000343000", "0.001234"},
+	{"18000000136400141A99BE1C000000000000000000403000", "123456789012"},
+	{"1800000013640000000000000000000000000000003EB000", "-0.0"},
+	{"180000001364000C00000000000000000000000000443000", "1.2E+3"},
+	{"180000001364007B000000000000000000000000002E3000", "1.23E-7"},
+	{"180000001364000100000000000000000000000000343000", "0.000001"},
+	{"180000001364000100000000000000000000000000323000", "1E-7"},
+	{"180000001364000000000000000000000000000000463000", "0E+3"},
+	{"180000001364000100000000000000000000000000000000", "1E-6176"},
+	{"180000001364000A00000000000000000000000000FE5F00", "1.0E+6112"},
+	{"18000000136400143AA09016DD4359643C0AD39B00183000", "123456789012.34567890123456789012"},
+	{"18000000136400000000000A5BC138938D44C64D31FE5F00", "1.000000000000000000000000000000000E+6144"},
+	{"18000000136400FFFFFFFF638E8D37C087ADBE09EDFF5F00", "9.999999999999999999999999999999999E+6144"},
+	{"18000000136400FFFFFFFF638E8D37C087ADBE09ED018000", "-9.999999999999999999999999999999999E-6143"},
+	{"180000001364000000000000000000000000000000007C00", "NaN"},
+	{"180000001364000000000000000000000000000000007800", "Infinity"},
+	{"18000000136400000000000000000000000000000000F800", "-Infinity"},
+}
+
+func (s *S) TestDecimal128(c *C) {
+	for i, item := range decimalItems {
+		data, err := hex.DecodeString(item.bson)
+		c.Assert(err, IsNil)
+
+		dec, err := bson.ParseDecimal128(item.string)
+		c.Assert(err, IsNil, Bug("Failed on item %d", i))
+		c.Assert(dec.String(), Equals, item.string, Bug("Failed on item %d", i))
+
+		out, err := bson.Marshal(bson.M{"d": dec})
+		c.Assert(err, IsNil)
+		c.Assert(hex.EncodeToString(out), Equals, strings.ToLower(item.bson), Bug("Failed on item %d", i))
+
+		var v struct{ D bson.Decimal128 }
+		err = bson.Unmarshal(data, &v)
+		c.Assert(err, IsNil)
+		c.Assert(v.D, Equals, dec, Bug("Failed on item %d", i))
+
+		var vs struct{ D string }
+		err = bson.Unmarshal(data, &vs)
+		c.Assert(err, IsNil)
+		c.Assert(vs.D, Equals, item.string, Bug("Failed on item %d", i))
+
+		m := bson.M{}
+		err = bson.Unmarshal(data, m)
+		c.Assert(err, IsNil)
+		c.Assert(m["d"], Equals, dec, Bug("Failed on item %d", i))
+
+		js, err := bson.MarshalExtJSON(bson.Raw{0x03, data}, true)
+		c.Assert(err, IsNil)
+		c.Assert(string(js), Equals, `{"d":{"$numberDecimal":"`+item.string+`"}}`)
+		var raw bson.Raw
+		err = bson.UnmarshalExtJSON(js, &raw)
+		c.Assert(err, IsNil)
+		c.Assert(string(raw.Data), Equals, string(data))
+	}
+}
+
+var decimalParseItems = []struct {
+	in, out string
+}{
+	{"+1", "1"},
+	{"00001.50", "1.50"},
+	{".5", "0.5"},
+	{"5.", "5"},
+	{"1e3", "1E+3"},
+	{"-1.2e-3", "-0.0012"},
+	{"0E-8000", "0E-6176"},
+	{"0E+8000", "0E+6111"},
+	{"1E+6144", "1.000000000000000000000000000000000E+6144"},
+	{"1000000000000000000000000000000000000", "1.000000000000000000000000000000000E+36"},
+	{"1.0000E-6175", "1.0E-6175"},
+	{"inf", "Infinity"},
+	{"-INFINITY", "-Infinity"},
+	{"nan", "NaN"},
+}
+
+func (s *S) TestParseDecimal128(c *C) {
+	for _, item := range decimalParseItems {
+		dec, err := bson.ParseDecimal128(item.in)
+		c.Assert(err, IsNil, Bug("Input: %q", item.in))
+		c.Assert(dec.String(), Equals, item.out, Bug("Input: %q", item.in))
+	}
+}
+
+var decimalParseErrorItems = []struct {
+	in, error string
+}{
+	{"", "no digits"},
+	{".", "no digits"},
+	{"-", "no digits"},
+	{"E3", "no digits"},
+	{"1.2.3", "unexpected dot"},
+	{"1x", `unexpected character "x"`},
+	{"0x1", `unexpected character "x"`},
+	{"1E", "invalid exponent"},
+	{"1e+", "invalid exponent"},
+	{"1E-6177", "exponent out of range"},
+	{"1E+6145", "exponent out of range"},
+	{"12345678901234567890123456789012345", "too many significant digits"},
+}
+
+func (s *S) TestParseDecimal128Errors(c *C) {
+	for _, item := range decimalParseErrorItems {
+		_, err := bson.ParseDecimal128(item.in)
+		expected := "Can't parse " + strconv.Quote(item.in) + " as a decimal: " + item.error
+		c.Assert(err, NotNil, Bug("Input: %q", item.in))
+		c.Assert(err.String(), Equals, expected)
+	}
+}
@@ -0,0 +1,771 @@
+// gobson - BSON library for Go.
+// 
+// Copyright (c) 2010-2011 - Gustavo Niemeyer <gustavo@niemeyer.net>
+// 
+// All rights reserved.
+// 
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// 
+//     * Redistributions of source code must retain the above copyright notice,
+//       this list of conditions and the following disclaimer.
+//     * Redistributions in binary form must reproduce the above copyright notice,
+//       this list of conditions and the following disclaimer in the documentation
+//       and/or other materials provided with the distribution.
+//     * Neither the name of the copyright holder nor the names of its
+//       contributors may be used to endorse or promote products derived from
+//       this software without specific prior written permission.
+// 
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+
+package bson
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"math"
+	"time"
+	"fmt"
+	"os"
+)
+
+// --------------------------------------------------------------------------
+// Extended JSON.
+//
+// Relevant documentation:
+//
+//     http://www.mongodb.org/display/DOCS/Mongo+Extended+JSON
+//
+
+// MarshalExtJSON returns the MongoDB extended JSON representation of the in
+// document, which may be a map, a struct, a D value, or a Raw document or
+// element.  The BSON types that have no plain JSON equivalent are
+// represented by objects with special keys, such as {"$oid": "<hex>"} for
+// ObjectId values, {"$date": ...} for Timestamp values, {"$binary": ...}
+// for Binary values, {"$numberLong": "<int>"} for int64 values,
+// {"$numberDecimal": "<dec>"} for Decimal128 values,
+// {"$regularExpression": ...} for RegEx values, {"$timestamp": ...} for
+// MongoTimestamp values, {"$symbol": "<str>"} for Symbol values, {"$code":
+// ...} for JS values, {"$minKey": 1} and {"$maxKey": 1} for MinKey and
+// MaxKey, and {"$undefined": true} for Undefined.
+//
+// In canonical mode the type of every value is preserved, including numbers
+// (e.g. {"$numberInt": "1"}).  Otherwise, the relaxed mode is used, in
+// which numbers are represented as plain JSON numbers, and dates between
+// the years 1970 and 9999 are represented in ISO-8601 format.
+func MarshalExtJSON(in interface{}, canonical bool) (out []byte, err os.Error) {
+	defer handleErr(&err)
+	var raw Raw
+	switch v := in.(type) {
+	case Raw:
+		raw = v
+	case *Raw:
+		raw = *v
+	default:
+		data, err := Marshal(in)
+		if err != nil {
+			return nil, err
+		}
+		raw = Raw{0x03, data}
+	}
+	if raw.Kind == 0x00 {
+		raw.Kind = 0x03
+	}
+	w := &extJSONWriter{decoder: decoder{in: raw.Data}, canonical: canonical}
+	w.writeElem(raw.Kind)
+	if w.i != len(w.in) {
+		corrupted()
+	}
+	return w.out, nil
+}
+
+// UnmarshalExtJSON parses the MongoDB extended JSON document in data, in
+// either canonical or relaxed mode, and unmarshals it into the out value
+// as done by Unmarshal.  The out value may also be a pointer to a D or Raw
+// value, in which case the order of the elements in data is preserved.
+//
+// In addition to the representations generated by MarshalExtJSON, the
+// legacy forms {"$regex": "<pattern>", "$options": "<options>"},
+// {"$binary": "<base64>", "$type": "<hex>"} and {"$date": <ms>} are
+// also accepted.  Plain JSON numbers are unmarshalled as int32 or int64
+// values if they have no fractional part or exponent, and as float64
+// values otherwise.
+func UnmarshalExtJSON(data []byte, out interface{}) (err os.Error) {
+	defer handleErr(&err)
+	p := &extJSONParser{in: data}
+	p.skipSpace()
+	if p.peek() != '{' {
+		p.fail("expected a document")
+	}
+	doc, ok := p.value().(D)
+	if !ok {
+		panic("Extended JSON value is not a document")
+	}
+	p.skipSpace()
+	if p.i != len(p.in) {
+		p.fail("unexpected data after the document")
+	}
+	in, err := Marshal(doc)
+	if err != nil {
+		return err
+	}
+	if d, ok := out.(*D); ok {
+		*d = (&decoder{in: in}).readDocD().(D)
+		return nil
+	}
+	return Unmarshal(in, out)
+}
+
+// --------------------------------------------------------------------------
+// Marshaling of BSON data as extended JSON.
+
+type extJSONWriter struct {
+	decoder
+	out       []byte
+	canonical bool
+}
+
+func (w *extJSONWriter) add(s string) {
+	w.out = append(w.out, []byte(s)...)
+}
+
+func (w *extJSONWriter) writeDoc(array bool) {
+	if array {
+		w.out = append(w.out, '[')
+	} else {
+		w.out = append(w.out, '{')
+	}
+	first := true
+	w.readDocWith(func(kind byte, name string) {
+		if !first {
+			w.out = append(w.out, ',')
+		}
+		first = false
+		if !array {
+			w.writeStr(name)
+			w.out = append(w.out, ':')
+		}
+		w.writeElem(kind)
+	})
+	if array {
+		w.out = append(w.out, ']')
+	} else {
+		w.out = append(w.out, '}')
+	}
+}
+
+func (w *extJSONWriter) writeElem(kind byte) {
+	switch kind {
+	case '\x01': // Float64
+		w.writeFloat64(w.readFloat64())
+	case '\x02': // UTF-8 string
+		w.writeStr(w.readStr())
+	case '\x03': // Document
+		w.writeDoc(false)
+	case '\x04': // Array
+		w.writeDoc(true)
+	case '\x05': // Binary
+		b := w.readBinary()
+		buf := make([]byte, base64.StdEncoding.EncodedLen(len(b.Data)))
+		base64.StdEncoding.Encode(buf, b.Data)
+		w.add(`{"$binary":{"base64":"`)
+		w.out = append(w.out, buf...)
+		w.add(`","subType":"` + hex.EncodeToString([]byte{b.Kind}) + `"}}`)
+	case '\x06': // Undefined
+		w.add(`{"$undefined":true}`)
+	case '\x07': // ObjectId
+		w.add(`{"$oid":"` + hex.EncodeToString(w.readBytes(12)) + `"}`)
+	case '\x08': // Bool
+		if w.readBool() {
+			w.add("true")
+		} else {
+			w.add("false")
+		}
+	case '\x09': // Timestamp
+		w.writeDate(w.readInt64())
+	case '\x0A': // Nil
+		w.add("null")
+	case '\x0B': // RegEx
+		re := w.readRegEx()
+		w.add(`{"$regularExpression":{"pattern":`)
+		w.writeStr(re.Pattern)
+		w.add(`,"options":`)
+		w.writeStr(re.Options)
+		w.add("}}")
+	case '\x0D': // JavaScript without scope
+		w.add(`{"$code":`)
+		w.writeStr(w.readStr())
+		w.add("}")
+	case '\x0E': // Symbol
+		w.add(`{"$symbol":`)
+		w.writeStr(w.readStr())
+		w.add("}")
+	case '\x0F': // JavaScript with scope
+		w.i += 4 // Skip length
+		w.add(`{"$code":`)
+		w.writeStr(w.readStr())
+		w.add(`,"$scope":`)
+		w.writeDoc(false)
+		w.add("}")
+	case '\x10': // Int32
+		i := strconv.Itoa(int(w.readInt32()))
+		if w.canonical {
+			w.add(`{"$numberInt":"` + i + `"}`)
+		} else {
+			w.add(i)
+		}
+	case '\x11': // Mongo-specific timestamp
+		u := uint64(w.readInt64())
+		t := strconv.Uitoa64(u >> 32)
+		i := strconv.Uitoa64(u & 0xFFFFFFFF)
+		w.add(`{"$timestamp":{"t":` + t + `,"i":` + i + `}}`)
+	case '\x12': // Int64
+		i := strconv.Itoa64(w.readInt64())
+		if w.canonical {
+			w.add(`{"$numberLong":"` + i + `"}`)
+		} else {
+			w.add(i)
+		}
+	case '\x13': // Decimal128
+		w.add(`{"$numberDecimal":"` + w.readDecimal128().String() + `"}`)
+	case '\x7F': // Max key
+		w.add(`{"$maxKey":1}`)
+	case '\xFF': // Min key
+		w.add(`{"$minKey":1}`)
+	default:
+		panic(fmt.Sprintf("Unknown element kind (0x%02X)", kind))
+	}
+}
+
+func (w *extJSONWriter) writeStr(s string) {
+	w.out = append(w.out, '"')
+	for i := 0; i != len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			w.out = append(w.out, '\\', c)
+		case c == '\n':
+			w.add(`\n`)
+		case c == '\r':
+			w.add(`\r`)
+		case c == '\t':
+			w.add(`\t`)
+		case c < 0x20:
+			w.add(fmt.Sprintf(`\u%04x`, c))
+		default:
+			w.out = append(w.out, c)
+		}
+	}
+	w.out = append(w.out, '"')
+}
+
+func (w *extJSONWriter) writeFloat64(f float64) {
+	var s string
+	switch {
+	case math.IsNaN(f):
+		s = "NaN"
+	case math.IsInf(f, 1):
+		s = "Infinity"
+	case math.IsInf(f, -1):
+		s = "-Infinity"
+	default:
+		s = strconv.Ftoa64(f, 'g', -1)
+		if strings.IndexAny(s, ".e") < 0 {
+			// Keep it a float when parsed back.
+			s += ".0"
+		}
+		if !w.canonical {
+			w.add(s)
+			return
+		}
+	}
+	w.add(`{"$numberDouble":"` + s + `"}`)
+}
+
+// maxISODate is the first millisecond of the year 10000.
+const maxISODate = 253402300800000
+
+func (w *extJSONWriter) writeDate(ms int64) {
+	if !w.canonical && ms >= 0 && ms < maxISODate {
+		s := time.SecondsToUTC(ms / 1000).Format("2006-01-02T15:04:05")
+		if ms%1000 != 0 {
+			s += fmt.Sprintf(".%03d", ms%1000)
+		}
+		w.add(`{"$date":"` + s + `Z"}`)
+	} else {
+		w.add(`{"$date":{"$numberLong":"` + strconv.Itoa64(ms) + `"}}`)
+	}
+}
+
+// --------------------------------------------------------------------------
+// Parsing of extended JSON into values that marshal back into BSON.
+
+type extJSONParser struct {
+	in []byte
+	i  int
+}
+
+func (p *extJSONParser) fail(what string) {
+	panic(fmt.Sprintf("Invalid extended JSON at offset %d: %s", p.i, what))
+}
+
+func (p *extJSONParser) peek() byte {
+	if p.i < len(p.in) {
+		return p.in[p.i]
+	}
+	return 0
+}
+
+func (p *extJSONParser) expect(c byte) {
+	if p.peek() != c {
+		p.fail(fmt.Sprintf("expected %q", c))
+	}
+	p.i++
+}
+
+func (p *extJSONParser) skipSpace() {
+	for p.i < len(p.in) {
+		switch p.in[p.i] {
+		case ' ', '\t', '\r', '\n':
+			p.i++
+		default:
+			return
+		}
+	}
+}
+
+func (p *extJSONParser) literal(lit string) bool {
+	end := p.i + len(lit)
+	if end <= len(p.in) && string(p.in[p.i:end]) == lit {
+		p.i = end
+		return true
+	}
+	return false
+}
+
+func (p *extJSONParser) value() interface{} {
+	p.skipSpace()
+	switch c := p.peek(); {
+	case c == '{':
+		return p.object()
+	case c == '[':
+		return p.array()
+	case c == '"':
+		return p.str()
+	case c == '-' || c >= '0' && c <= '9':
+		return p.number()
+	case p.literal("true"):
+		return true
+	case p.literal("false"):
+		return false
+	case p.literal("null"):
+		return nil
+	case c == 0:
+		p.fail("unexpected end of input")
+	}
+	p.fail(fmt.Sprintf("unexpected character %q", p.in[p.i]))
+	panic("unreached")
+}
+
+func (p *extJSONParser) object() interface{} {
+	p.expect('{')
+	d := make(D, 0, 8)
+	p.skipSpace()
+	if p.peek() == '}' {
+		p.i++
+		return d
+	}
+	for {
+		p.skipSpace()
+		if p.peek() != '"' {
+			p.fail("expected a key string")
+		}
+		name := p.str()
+		p.skipSpace()
+		p.expect(':')
+		d = append(d, DocElem{name, p.value()})
+		p.skipSpace()
+		if p.peek() != ',' {
+			break
+		}
+		p.i++
+	}
+	p.expect('}')
+	if strings.HasPrefix(d[0].Name, "$") {
+		if v, ok := extJSONValue(d); ok {
+			return v
+		}
+	}
+	return d
+}
+
+func (p *extJSONParser) array() interface{} {
+	p.expect('[')
+	a := make([]interface{}, 0, 8)
+	p.skipSpace()
+	if p.peek() == ']' {
+		p.i++
+		return a
+	}
+	for {
+		a = append(a, p.value())
+		p.skipSpace()
+		if p.peek() != ',' {
+			break
+		}
+		p.i++
+	}
+	p.expect(']')
+	return a
+}
+
+func (p *extJSONParser) number() interface{} {
+	start := p.i
+	isFloat := false
+	for ; p.i < len(p.in); p.i++ {
+		c := p.in[p.i]
+		if c == '.' || c == 'e' || c == 'E' {
+			isFloat = true
+		} else if c != '-' && c != '+' && (c < '0' || c > '9') {
+			break
+		}
+	}
+	s := string(p.in[start:p.i])
+	if isFloat {
+		f, err := strconv.Atof64(s)
+		if err != nil {
+			p.fail("invalid number " + s)
+		}
+		return f
+	}
+	i, err := strconv.Atoi64(s)
+	if err != nil {
+		p.fail("invalid number " + s)
+	}
+	if i >= math.MinInt32 && i <= math.MaxInt32 {
+		return int(i)
+	}
+	return i
+}
+
+func (p *extJSONParser) str() string {
+	p.expect('"')
+	var buf []byte
+	for {
+		c := p.peek()
+		p.i++
+		switch {
+		case c == '"':
+			return string(buf)
+		case c == '\\':
+			e := p.peek()
+			p.i++
+			switch e {
+			case '"', '\\', '/':
+				buf = append(buf, e)
+			case 'b':
+				buf = append(buf, '\b')
+			case 'f':
+				buf = append(buf, '\f')
+			case 'n':
+				buf = append(buf, '\n')
+			case 'r':
+				buf = append(buf, '\r')
+			case 't':
+				buf = append(buf, '\t')
+			case 'u':
+				r := p.hex4()
+				if r >= 0xD800 && r < 0xDC00 && p.literal(`\u`) {
+					r2 := p.hex4()
+					if r2 >= 0xDC00 && r2 < 0xE000 {
+						r = (r-0xD800)<<10 | (r2 - 0xDC00) + 0x10000
+					} else {
+						buf = append(buf, []byte(string(r))...)
+						r = r2
+					}
+				}
+				buf = append(buf, []byte(string(r))...)
+			default:
+				p.i--
+				p.fail("invalid escape in string")
+			}
+		case p.i > len(p.in):
+			p.i--
+			p.fail("unterminated string")
+		case c < 0x20:
+			p.i--
+			p.fail("control character in string")
+		default:
+			buf = append(buf, c)
+		}
+	}
+	panic("unreached")
+}
+
+func (p *extJSONParser) hex4() int {
+	if p.i+4 > len(p.in) {
+		p.fail("invalid unicode escape in string")
+	}
+	r := 0
+	for _, c := range p.in[p.i : p.i+4] {
+		r <<= 4
+		switch {
+		case c >= '0' && c <= '9':
+			r |= int(c - '0')
+		case c >= 'a' && c <= 'f':
+			r |= int(c - 'a' + 10)
+		case c >= 'A' && c <= 'F':
+			r |= int(c - 'A' + 10)
+		default:
+			p.fail("invalid unicode escape in string")
+		}
+	}
+	p.i += 4
+	return r
+}
+
+// extJSONValue returns the value represented by the d document if it's
+// one of the special extended JSON objects.  Objects which have a special
+// key but are malformed otherwise are reported as errors, except for
+// those using the $regex key, which may also be a query operator.
+func extJSONValue(d D) (interface{}, bool) {
+	name := d[0].Name
+	v := d[0].Value
+	bad := func() {
+		panic("Invalid extended JSON " + name + " value")
+	}
+	if len(d) == 2 {
+		switch {
+		case name == "$regex" && d[1].Name == "$options":
+			pattern, ok1 := v.(string)
+			options, ok2 := d[1].Value.(string)
+			if ok1 && ok2 {
+				return RegEx{pattern, options}, true
+			}
+			return nil, false
+		case name == "$binary" && d[1].Name == "$type":
+			data, ok1 := v.(string)
+			kind, ok2 := d[1].Value.(string)
+			if !ok1 || !ok2 {
+				bad()
+			}
+			return extJSONBinary(data, kind), true
+		case name == "$code" && d[1].Name == "$scope":
+			code, ok1 := v.(string)
+			scope, ok2 := d[1].Value.(D)
+			if !ok1 || !ok2 {
+				bad()
+			}
+			return JS{code, scope}, true
+		}
+		return nil, false
+	}
+	if len(d) != 1 {
+		return nil, false
+	}
+	switch name {
+	case "$oid":
+		s, _ := v.(string)
+		id, err := hex.DecodeString(s)
+		if err != nil || len(id) != 12 {
+			bad()
+		}
+		return ObjectId(id), true
+	case "$symbol":
+		s, ok := v.(string)
+		if !ok {
+			bad()
+		}
+		return Symbol(s), true
+	case "$code":
+		s, ok := v.(string)
+		if !ok {
+			bad()
+		}
+		return JS{Code: s}, true
+	case "$numberInt":
+		s, _ := v.(string)
+		i, err := strconv.Atoi64(s)
+		if err != nil || i < math.MinInt32 || i > math.MaxInt32 {
+			bad()
+		}
+		return int(i), true
+	case "$numberLong":
+		s, _ := v.(string)
+		i, err := strconv.Atoi64(s)
+		if err != nil {
+			bad()
+		}
+		return i, true
+	case "$numberDouble":
+		s, _ := v.(string)
+		switch s {
+		case "NaN":
+			return math.NaN(), true
+		case "Infinity":
+			return math.Inf(1), true
+		case "-Infinity":
+			return math.Inf(-1), true
+		}
+		f, err := strconv.Atof64(s)
+		if err != nil {
+			bad()
+		}
+		return f, true
+	case "$numberDecimal":
+		s, _ := v.(string)
+		dec, err := ParseDecimal128(s)
+		if err != nil {
+			bad()
+		}
+		return dec, true
+	case "$binary":
+		b, ok := v.(D)
+		if !ok || len(b) != 2 {
+			bad()
+		}
+		m := b.Map()
+		data, ok1 := m["base64"].(string)
+		kind, ok2 := m["subType"].(string)
+		if !ok1 || !ok2 {
+			bad()
+		}
+		return extJSONBinary(data, kind), true
+	case "$regularExpression":
+		re, ok := v.(D)
+		if !ok || len(re) != 2 {
+			bad()
+		}
+		m := re.Map()
+		pattern, ok1 := m["pattern"].(string)
+		options, ok2 := m["options"].(string)
+		if !ok1 || !ok2 {
+			bad()
+		}
+		return RegEx{pattern, options}, true
+	case "$timestamp":
+		ts, ok := v.(D)
+		if !ok || len(ts) != 2 {
+			bad()
+		}
+		m := ts.Map()
+		t, ok1 := extJSONInt(m["t"])
+		i, ok2 := extJSONInt(m["i"])
+		if !ok1 || !ok2 || t < 0 || t > math.MaxUint32 || i < 0 || i > math.MaxUint32 {
+			bad()
+		}
+		return MongoTimestamp(t<<32 | i), true
+	case "$date":
+		if s, ok := v.(string); ok {
+			ms, ok := parseISODate(s)
+			if !ok {
+				bad()
+			}
+			return Timestamp(ms * 1e6), true
+		}
+		ms, ok := extJSONInt(v)
+		if !ok {
+			bad()
+		}
+		return Timestamp(ms * 1e6), true
+	case "$minKey", "$maxKey":
+		if i, ok := extJSONInt(v); !ok || i != 1 {
+			bad()
+		}
+		if name == "$minKey" {
+			return MinKey, true
+		}
+		return MaxKey, true
+	case "$undefined":
+		if b, ok := v.(bool); !ok || !b {
+			bad()
+		}
+		return Undefined, true
+	}
+	return nil, false
+}
+
+func extJSONInt(v interface{}) (int64, bool) {
+	switch i := v.(type) {
+	case int:
+		return int64(i), true
+	case int64:
+		return i, true
+	}
+	return 0, false
+}
+
+func extJSONBinary(data, kind string) interface{} {
+	k, err := hex.DecodeString(kind)
+	if err != nil || len(k) != 1 {
+		panic("Invalid extended JSON binary subtype: " + kind)
+	}
+	buf := make([]byte, base64.StdEncoding.DecodedLen(len(data)))
+	n, err := base64.StdEncoding.Decode(buf, []byte(data))
+	if err != nil {
+		panic("Invalid extended JSON binary data: " + err.String())
+	}
+	return Binary{k[0], buf[:n]}
+}
+
+// parseISODate parses an ISO-8601 date such as "2011-10-18T15:04:05.123Z"
+// or "2011-10-18T15:04:05-02:00", and returns the respective number of
+// milliseconds since the epoch.
+func parseISODate(s string) (ms int64, ok bool) {
+	if len(s) < 20 {
+		return 0, false
+	}
+	t, err := time.Parse("2006-01-02T15:04:05", s[:19])
+	if err != nil {
+		return 0, false
+	}
+	ms = t.Seconds() * 1000
+	s = s[19:]
+	if s[0] == '.' {
+		i := 1
+		for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+			i++
+		}
+		frac := s[1:i]
+		if frac == "" {
+			return 0, false
+		}
+		for len(frac) < 3 {
+			frac += "0"
+		}
+		n, _ := strconv.Atoi64(frac[:3])
+		ms += n
+		s = s[i:]
+	}
+	if s == "Z" {
+		return ms, true
+	}
+	if len(s) == 6 && s[3] == ':' {
+		s = s[:3] + s[4:]
+	}
+	if len(s) != 5 || s[0] != '+' && s[0] != '-' {
+		return 0, false
+	}
+	hh, err1 := strconv.Atoi(s[1:3])
+	mm, err2 := strconv.Atoi(s[3:5])
+	if err1 != nil || err2 != nil {
+		return 0, false
+	}
+	offset := int64(hh*60+mm) * 60000
+	if s[0] == '+' {
+		ms -= offset
+	} else {
+		ms += offset
+	}
+	return ms, true
+}
@@ -0,0 +1,181 @@
+// gobson - BSON library for Go.
+// 
+// Copyright (c) 2010-2011 - Gustavo Niemeyer <gustavo@niemeyer.net>
+// 
+// All rights reserved.
+// 
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// 
+//     * Redistributions of source code must retain the above copyright notice,
+//       this list of conditions and the following disclaimer.
+//     * Redistributions in binary form must reproduce the above copyright notice,
+//       this list of conditions and the following disclaimer in the documentation
+//       and/or other materials provided with the distribution.
+//     * Neither the name of the copyright holder nor the names of its
+//       contributors may be used to endorse or promote products derived from
+//       this software without specific prior written permission.
+// 
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+
+package bson
+
+import (
+	"strings"
+	"fmt"
+	"os"
+)
+
+// RawDocument is a BSON document in its encoded form, which may be
+// validated and inspected without unmarshalling it.  The elements
+// obtained from it refer to the document data itself, rather than to
+// copies of it.  The Data of a Raw document may be used as a
+// RawDocument by converting it:
+//
+//     id, err := bson.RawDocument(raw.Data).Lookup("_id")
+//
+type RawDocument []byte
+
+// RawDocElem is an element of a RawDocument, as returned by its Elements
+// method.
+type RawDocElem struct {
+	Name  string
+	Value Raw
+}
+
+// ElemNotFound is returned by RawDocument.Lookup when there's no element
+// in the document for the provided path.
+var ElemNotFound = os.NewError("Element not found")
+
+// Validate verifies that doc holds a single well formed BSON document,
+// including all the elements nested within it.
+func (doc RawDocument) Validate() (err os.Error) {
+	defer handleErr(&err)
+	d := &decoder{in: doc}
+	d.readDocTo(blackHole)
+	if d.i != len(doc) {
+		corrupted()
+	}
+	return nil
+}
+
+// Elements returns the elements of doc, in the order they're found in it.
+// Only the boundaries of each element are verified.  The values of the
+// elements aren't validated.
+func (doc RawDocument) Elements() (elems []RawDocElem, err os.Error) {
+	defer handleErr(&err)
+	d := &decoder{in: doc}
+	d.readDocWith(func(kind byte, name string) {
+		start := d.i
+		d.skipElem(kind)
+		elems = append(elems, RawDocElem{name, Raw{kind, d.in[start:d.i]}})
+	})
+	if d.i != len(doc) {
+		corrupted()
+	}
+	return elems, nil
+}
+
+// Lookup returns the element of doc at the provided path, which is a
+// sequence of element names separated by dots.  Elements of nested
+// documents are looked up by their name, and elements of arrays by their
+// index.  For instance, the path "a.b.0.c" refers to the "c" element of
+// the first document in the "b" array of the "a" document.  If there's no
+// element at the provided path, ElemNotFound is returned.
+//
+// Only the elements preceding the ones at the provided path are walked
+// through, and no values are decoded, so this is a cheap way to peek at
+// elements such as "_id" or "$err".
+func (doc RawDocument) Lookup(path string) (value Raw, err os.Error) {
+	defer handleErr(&err)
+	value = Raw{0x03, doc}
+	for _, key := range strings.Split(path, ".") {
+		if value.Kind != 0x03 && value.Kind != 0x04 {
+			return Raw{}, ElemNotFound
+		}
+		var found bool
+		value, found = lookupElem(value.Data, key)
+		if !found {
+			return Raw{}, ElemNotFound
+		}
+	}
+	return value, nil
+}
+
+// lookupElem returns the element with the given name in the document or
+// array in data, stopping as soon as it's found.
+func lookupElem(data []byte, key string) (Raw, bool) {
+	d := &decoder{in: data}
+	end := int(d.readInt32())
+	if end < 5 || end > len(data) || data[end-1] != '\x00' {
+		corrupted()
+	}
+	d.in = data[:end]
+	for {
+		if d.i >= end {
+			corrupted()
+		}
+		if d.in[d.i] == '\x00' {
+			break
+		}
+		kind := d.readByte()
+		name := d.readCStr()
+		start := d.i
+		d.skipElem(kind)
+		if name == key {
+			return Raw{kind, d.in[start:d.i]}, true
+		}
+	}
+	return Raw{}, false
+}
+
+// skipElem moves past the value of an element of the given kind, only
+// verifying that its boundaries are sane.
+func (d *decoder) skipElem(kind byte) {
+	switch kind {
+	case '\x06', '\x0A', '\x7F', '\xFF': // Undefined, Nil, Max key, Min key
+	case '\x08': // Bool
+		d.readBytes(1)
+	case '\x10': // Int32
+		d.readBytes(4)
+	case '\x01', '\x09', '\x11', '\x12': // Float64, Timestamps, Int64
+		d.readBytes(8)
+	case '\x07': // ObjectId
+		d.readBytes(12)
+	case '\x13': // Decimal128
+		d.readBytes(16)
+	case '\x02', '\x0D', '\x0E': // UTF-8 string, JavaScript, Symbol
+		l := d.readInt32()
+		if l < 1 {
+			corrupted()
+		}
+		if d.readBytes(l)[l-1] != '\x00' {
+			corrupted()
+		}
+	case '\x03', '\x04', '\x0F': // Document, Array, JavaScript with scope
+		l := d.readInt32()
+		if l < 5 {
+			corrupted()
+		}
+		d.readBytes(l - 4)
+	case '\x05': // Binary
+		l := d.readInt32()
+		if l < 0 {
+			corrupted()
+		}
+		d.readBytes(l + 1)
+	case '\x0B': // RegEx
+		d.readCStr()
+		d.readCStr()
+	default:
+		panic(fmt.Sprintf("Unknown element kind (0x%02X)", kind))
+	}
+}
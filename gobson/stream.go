@@ -0,0 +1,143 @@
+// gobson - BSON library for Go.
+// 
+// Copyright (c) 2010-2011 - Gustavo Niemeyer <gustavo@niemeyer.net>
+// 
+// All rights reserved.
+// 
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// 
+//     * Redistributions of source code must retain the above copyright notice,
+//       this list of conditions and the following disclaimer.
+//     * Redistributions in binary form must reproduce the above copyright notice,
+//       this list of conditions and the following disclaimer in the documentation
+//       and/or other materials provided with the distribution.
+//     * Neither the name of the copyright holder nor the names of its
+//       contributors may be used to endorse or promote products derived from
+//       this software without specific prior written permission.
+// 
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+
+package bson
+
+import (
+	"reflect"
+	"fmt"
+	"io"
+	"os"
+)
+
+// defaultMaxDocSize is the default maximum size of documents read by
+// a Decoder, matching the maximum document size accepted by MongoDB.
+const defaultMaxDocSize = 16 * 1024 * 1024
+
+// A Decoder reads and unmarshals BSON documents from an input stream,
+// such as a file created by mongodump, one at a time.
+type Decoder struct {
+	r       io.Reader
+	buf     []byte
+	maxSize int
+}
+
+// NewDecoder returns a new decoder that reads from r.
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: r, maxSize: defaultMaxDocSize}
+}
+
+// SetMaxSize sets the maximum size in bytes of the documents the decoder
+// will read.  Attempting to decode a document larger than that results in
+// an error, rather than in the allocation of a buffer for it.  The default
+// maximum size is 16MB.
+func (dec *Decoder) SetMaxSize(size int) {
+	dec.maxSize = size
+}
+
+// Decode reads the next BSON document from the input and unmarshals it
+// into the out value, as done by Unmarshal.  At the end of the input,
+// os.EOF is returned.  If the input ends in the middle of a document,
+// io.ErrUnexpectedEOF is returned instead.
+//
+// The decoder reuses its buffer for every document read, and Raw values
+// and byte slices unmarshalled into out refer to that buffer, so they are
+// only valid until the next call to Decode or DecodeRaw.  Copy them if
+// they must be kept for longer.
+func (dec *Decoder) Decode(out interface{}) os.Error {
+	data, err := dec.readDoc()
+	if err != nil {
+		return err
+	}
+	return Unmarshal(data, out)
+}
+
+// DecodeRaw reads the next BSON document from the input and returns it
+// without unmarshalling it.  As with Decode, the returned document refers
+// to the buffer of the decoder, and is only valid until the next call to
+// Decode or DecodeRaw.
+func (dec *Decoder) DecodeRaw() (Raw, os.Error) {
+	data, err := dec.readDoc()
+	if err != nil {
+		return Raw{}, err
+	}
+	return Raw{0x03, data}, nil
+}
+
+func (dec *Decoder) readDoc() ([]byte, os.Error) {
+	if cap(dec.buf) < initialBufferSize {
+		dec.buf = make([]byte, initialBufferSize)
+	}
+	b := dec.buf[:4]
+	_, err := io.ReadFull(dec.r, b)
+	if err != nil {
+		return nil, err
+	}
+	size := int(int32(uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16 | uint32(b[3])<<24))
+	if size < 5 {
+		return nil, os.NewError(fmt.Sprintf("Invalid BSON document size: %d", size))
+	}
+	if size > dec.maxSize {
+		return nil, os.NewError(fmt.Sprintf("BSON document size %d exceeds the maximum of %d", size, dec.maxSize))
+	}
+	if cap(dec.buf) < size {
+		buf := make([]byte, size)
+		copy(buf, b)
+		dec.buf = buf
+	}
+	b = dec.buf[:size]
+	_, err = io.ReadFull(dec.r, b[4:])
+	if err == os.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// An Encoder marshals and writes BSON documents to an output stream.
+type Encoder struct {
+	w io.Writer
+	e encoder
+}
+
+// NewEncoder returns a new encoder that writes to w.
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w, e: encoder{make([]byte, 0, initialBufferSize)}}
+}
+
+// Encode marshals the in document, as done by Marshal, and writes it to
+// the output.  The encoder reuses its buffer for every document written.
+func (enc *Encoder) Encode(in interface{}) (err os.Error) {
+	defer handleErr(&err)
+	enc.e.out = enc.e.out[:0]
+	enc.e.addDoc(reflect.ValueOf(in))
+	_, err = enc.w.Write(enc.e.out)
+	return err
+}
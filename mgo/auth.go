@@ -31,16 +31,53 @@
 package mgo
 
 import (
+	"asn1"
 	"crypto/md5"
+	"crypto/tls"
 	"encoding/hex"
 	"fmt"
 	"github.com/CloudMarc/mgo/gobson"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
 )
 
 type authInfo struct {
 	db, user, pass string
+	mechanism      string
+
+	// provider, if set, is consulted for the user, pass and mechanism
+	// whenever a socket must be authenticated.
+	provider *providerRef
+}
+
+// providerRef wraps a CredentialProvider so that logins made with it may
+// be compared by identity, whatever the dynamic type of the provider.
+type providerRef struct {
+	CredentialProvider
+}
+
+func (a authInfo) sameAs(b authInfo) bool {
+	if a.provider != nil || b.provider != nil {
+		// Sockets logged in with credentials obtained from the
+		// same provider stay valid across credential refreshes.
+		return a.db == b.db && a.provider == b.provider
+	}
+	return a.db == b.db && a.user == b.user && a.pass == b.pass && a.mechanism == b.mechanism
+}
+
+// resolve returns a copy of auth with the credentials obtained from its
+// provider.  If refresh is true, the provider is asked to renew them.
+func (a authInfo) resolve(refresh bool) (authInfo, os.Error) {
+	cred, err := a.provider.Credential(refresh)
+	if err != nil {
+		return a, os.NewError("Can't obtain credentials: " + err.String())
+	}
+	a.user = cred.Username
+	a.pass = cred.Password
+	a.mechanism = cred.Mechanism
+	return a, nil
 }
 
 type authCmd struct {
@@ -48,11 +85,27 @@ type authCmd struct {
 	Nonce, User, Key string
 }
 
+type authX509Cmd struct {
+	Authenticate int
+	Mechanism    string
+	User         string "user,omitempty"
+}
+
 type authResult struct {
 	ErrMsg string
 	Ok     bool
 }
 
+// authError is returned when the server rejects the credentials used
+// for logging in, as opposed to failing to run the login at all.
+type authError struct {
+	msg string
+}
+
+func (err *authError) String() string {
+	return err.msg
+}
+
 type getNonceCmd struct {
 	GetNonce int
 }
@@ -67,118 +120,402 @@ type logoutCmd struct {
 	Logout int
 }
 
+type saslCmd struct {
+	Start          int    "saslStart,omitempty"
+	Continue       int    "saslContinue,omitempty"
+	ConversationId int    "conversationId,omitempty"
+	Mechanism      string "mechanism,omitempty"
+	Payload        []byte
+}
+
+type saslResult struct {
+	Ok             bool "ok"
+	Done           bool
+	ConversationId int "conversationId"
+	Payload        []byte
+	ErrMsg         string
+}
+
+// The nonce used by the MONGODB-CR mechanism is obtained lazily, only when
+// a socket is first asked to authenticate with it.  Each nonce is used for
+// a single login attempt, and concurrent logins on the same socket take
+// turns through the following states.
+const (
+	nonceIdle      = iota // No nonce available or requested.
+	nonceRequested        // A getnonce command is in flight.
+	nonceReady            // A nonce or an error is waiting to be taken.
+)
+
+// getNonce returns a fresh nonce for authenticating through the socket,
+// requesting one from the server if necessary.
 func (socket *mongoSocket) getNonce() (nonce string, err os.Error) {
 	socket.Lock()
-	for socket.cachedNonce == "" && socket.dead == nil {
+	for {
+		if socket.dead != nil {
+			err = socket.dead
+			break
+		}
+		if socket.nonceState == nonceReady {
+			debugf("Socket %p to %s: got nonce", socket, socket.addr)
+			nonce, err = socket.nonce, socket.nonceErr
+			socket.nonce, socket.nonceErr = "", nil
+			socket.nonceState = nonceIdle
+			break
+		}
+		if socket.nonceState == nonceIdle {
+			socket.nonceState = nonceRequested
+			socket.Unlock()
+			err = socket.requestNonce()
+			socket.Lock()
+			if err != nil {
+				socket.nonceState = nonceIdle
+				socket.gotNonce.Broadcast()
+				break
+			}
+			continue
+		}
 		debugf("Socket %p to %s: waiting for nonce", socket, socket.addr)
 		socket.gotNonce.Wait()
 	}
-	if socket.cachedNonce == "mongos" {
-		socket.Unlock()
-		return "", os.NewError("Can't authenticate with mongos; see http://j.mp/mongos-auth")
-	}
-	debugf("Socket %p to %s: got nonce", socket, socket.addr)
-	nonce, err = socket.cachedNonce, socket.dead
-	socket.cachedNonce = ""
 	socket.Unlock()
 	if err != nil {
-		nonce = ""
+		return "", err
 	}
-	return
+	if nonce == "mongos" {
+		return "", os.NewError("Can't authenticate with mongos; see http://j.mp/mongos-auth")
+	}
+	return nonce, nil
 }
 
-func (socket *mongoSocket) resetNonce() {
+// requestNonce sends a getnonce command through the socket.  The reply
+// moves the socket to the nonceReady state and wakes up any waiters.
+func (socket *mongoSocket) requestNonce() os.Error {
 	debugf("Socket %p to %s: requesting a new nonce", socket, socket.addr)
 	op := &queryOp{}
 	op.query = &getNonceCmd{GetNonce: 1}
 	op.collection = "admin.$cmd"
 	op.limit = -1
 	op.replyFunc = func(err os.Error, reply *replyOp, docNum int, docData []byte) {
+		var nonce string
 		if err != nil {
-			socket.kill(os.NewError("getNonce: " + err.String()))
-			return
-		}
-		result := &getNonceResult{}
-		err = bson.Unmarshal(docData, &result)
-		if err != nil {
-			socket.kill(os.NewError("Failed to unmarshal nonce: " + err.String()))
-			return
-		}
-		debugf("Socket %p to %s: nonce unmarshalled: %#v", socket, socket.addr, result)
-		if result.Code == 13390 {
-			// mongos doesn't yet support auth (see http://j.mp/mongos-auth)
-			result.Nonce = "mongos"
-		} else if result.Nonce == "" {
-			var msg string
-			if result.Err != "" {
-				msg = fmt.Sprintf("Got an empty nonce: %s (%d)", result.Err, result.Code)
+			err = os.NewError("getNonce: " + err.String())
+		} else {
+			result := &getNonceResult{}
+			err = bson.Unmarshal(docData, &result)
+			if err != nil {
+				err = os.NewError("Failed to unmarshal nonce: " + err.String())
+			} else if result.Code == 13390 {
+				// mongos doesn't yet support auth (see http://j.mp/mongos-auth)
+				nonce = "mongos"
+			} else if result.Nonce == "" {
+				if result.Err != "" {
+					err = os.NewError(fmt.Sprintf("Got an empty nonce: %s (%d)", result.Err, result.Code))
+				} else {
+					err = os.NewError("Got an empty nonce")
+				}
 			} else {
-				msg = "Got an empty nonce"
+				debugf("Socket %p to %s: nonce unmarshalled: %#v", socket, socket.addr, result)
+				nonce = result.Nonce
 			}
-			socket.kill(os.NewError(msg))
-			return
 		}
 		socket.Lock()
-		if socket.cachedNonce != "" {
-			socket.Unlock()
-			panic("resetNonce: nonce already cached")
-		}
-		socket.cachedNonce = result.Nonce
-		socket.gotNonce.Signal()
+		socket.nonce, socket.nonceErr = nonce, err
+		socket.nonceState = nonceReady
+		socket.gotNonce.Broadcast()
 		socket.Unlock()
 	}
-	err := socket.Query(op)
-	if err != nil {
-		socket.kill(os.NewError("resetNonce: " + err.String()))
-	}
+	return socket.Query(op)
 }
 
-func (socket *mongoSocket) Login(db string, user string, pass string) os.Error {
+// Login authenticates the socket with the provided credentials, unless
+// it is already authenticated with them.  The authentication mechanism
+// to use is selected by auth.mechanism, defaulting to MONGODB-CR.
+func (socket *mongoSocket) Login(auth authInfo) os.Error {
 	socket.Lock()
 	for _, a := range socket.auth {
-		if a.db == db && a.user == user && a.pass == pass {
-			debugf("Socket %p to %s: login: db=%q user=%q (already logged in)", socket, socket.addr, db, user)
+		if a.sameAs(auth) {
+			debugf("Socket %p to %s: login: db=%q user=%q (already logged in)", socket, socket.addr, auth.db, auth.user)
 			socket.Unlock()
 			return nil
 		}
 	}
-	if auth, found := socket.dropLogout(db, user, pass); found {
-		debugf("Socket %p to %s: login: db=%q user=%q (cached)", socket, socket.addr, db, user)
+	if socket.dropLogout(auth) {
+		debugf("Socket %p to %s: login: db=%q user=%q (cached)", socket, socket.addr, auth.db, auth.user)
 		socket.auth = append(socket.auth, auth)
 		socket.Unlock()
 		return nil
 	}
 	socket.Unlock()
 
-	debugf("Socket %p to %s: login: db=%q user=%q", socket, socket.addr, db, user)
+	if auth.provider == nil {
+		return socket.loginMechanism(auth)
+	}
 
-	// Note that this only works properly because this function is
-	// synchronous, which means the nonce won't get reset while we're
-	// using it and any other login requests will block waiting for a
-	// new nonce provided in the defer call below.
-	nonce, err := socket.getNonce()
+	// A rejected login may be due to the credentials having been rotated,
+	// so ask the provider for fresh ones and try once more.  Other errors,
+	// such as network failures, aren't fixed by new credentials.
+	err := socket.loginProvided(auth, false)
+	if _, ok := err.(*authError); ok {
+		debugf("Socket %p to %s: login failed, refreshing credentials: %s", socket, socket.addr, err)
+		err = socket.loginProvided(auth, true)
+	}
+	return err
+}
+
+func (socket *mongoSocket) loginProvided(auth authInfo, refresh bool) os.Error {
+	auth, err := auth.resolve(refresh)
 	if err != nil {
 		return err
 	}
-	defer socket.resetNonce()
+	return socket.loginMechanism(auth)
+}
+
+func (socket *mongoSocket) loginMechanism(auth authInfo) os.Error {
+	debugf("Socket %p to %s: login: db=%q user=%q mechanism=%q", socket, socket.addr, auth.db, auth.user, auth.mechanism)
+
+	var err os.Error
+	switch auth.mechanism {
+	case "", "MONGODB-CR":
+		err = socket.loginClassic(auth)
+	case "SCRAM-SHA-1", "SCRAM-SHA-256":
+		err = socket.loginSASL(auth)
+	case "MONGODB-X509":
+		err = socket.loginX509(auth)
+	default:
+		err = os.NewError("Unknown authentication mechanism: " + auth.mechanism)
+	}
+
+	if err != nil {
+		debugf("Socket %p to %s: login error: %s", socket, socket.addr, err)
+	} else {
+		debugf("Socket %p to %s: login successful", socket, socket.addr)
+	}
+	return err
+}
 
+// passwordDigest returns the MONGODB-CR digest of the user password, as
+// stored in the system.users collection.
+func passwordDigest(user, pass string) string {
 	psum := md5.New()
 	psum.Write([]byte(user + ":mongo:" + pass))
+	return hex.EncodeToString(psum.Sum())
+}
+
+func (socket *mongoSocket) loginClassic(auth authInfo) os.Error {
+	nonce, err := socket.getNonce()
+	if err != nil {
+		return err
+	}
 
 	ksum := md5.New()
-	ksum.Write([]byte(nonce + user))
-	ksum.Write([]byte(hex.EncodeToString(psum.Sum())))
+	ksum.Write([]byte(nonce + auth.user))
+	ksum.Write([]byte(passwordDigest(auth.user, auth.pass)))
 
 	key := hex.EncodeToString(ksum.Sum())
 
-	cmd := authCmd{Authenticate: 1, User: user, Nonce: nonce, Key: key}
+	cmd := authCmd{Authenticate: 1, User: auth.user, Nonce: nonce, Key: key}
+	result := authResult{}
+	return socket.loginRun(auth.db, &cmd, &result, func() os.Error {
+		if !result.Ok {
+			return &authError{result.ErrMsg}
+		}
+		socket.Lock()
+		socket.dropAuth(auth.db)
+		socket.auth = append(socket.auth, auth)
+		socket.Unlock()
+		return nil
+	})
+}
 
+func (socket *mongoSocket) loginX509(auth authInfo) os.Error {
+	if auth.db != "$external" {
+		return os.NewError("MONGODB-X509 authentication must be done against the $external database")
+	}
+	user := auth.user
+	if user == "" {
+		// No locking, certSubject never changes.
+		user = socket.certSubject
+		if user == "" {
+			return os.NewError("MONGODB-X509 authentication requires a TLS client certificate")
+		}
+	}
+
+	cmd := authX509Cmd{Authenticate: 1, Mechanism: "MONGODB-X509", User: user}
+	result := authResult{}
+	return socket.loginRun(auth.db, &cmd, &result, func() os.Error {
+		if !result.Ok {
+			return &authError{result.ErrMsg}
+		}
+		socket.Lock()
+		socket.dropAuth(auth.db)
+		socket.auth = append(socket.auth, auth)
+		socket.Unlock()
+		return nil
+	})
+}
+
+// certificateSubject returns the subject of the leaf certificate in cert
+// formatted as an RFC 2253 distinguished name, which is how the server
+// identifies MONGODB-X509 users.  The name is built from the relative
+// distinguished names as encoded in the certificate, so that attributes
+// and multi-valued names are reproduced exactly.
+func certificateSubject(cert tls.Certificate) (string, os.Error) {
+	if len(cert.Certificate) == 0 {
+		return "", os.NewError("TLS certificate is empty")
+	}
+	var parsed rawCertificate
+	_, err := asn1.Unmarshal(cert.Certificate[0], &parsed)
+	if err != nil {
+		return "", os.NewError("Can't parse TLS certificate: " + err.String())
+	}
+	subject := parsed.TBSCertificate.Subject
+	if len(subject) == 0 {
+		return "", os.NewError("TLS certificate has an empty subject")
+	}
+
+	// RFC 2253 lists the most specific names first, which is the
+	// reverse of the order in which they're encoded.  The values of
+	// multi-valued names are reversed as well, as done by the server.
+	rdns := make([]string, 0, len(subject))
+	for i := len(subject) - 1; i >= 0; i-- {
+		atvs := make([]string, 0, len(subject[i]))
+		for j := len(subject[i]) - 1; j >= 0; j-- {
+			atvs = append(atvs, formatDNAttribute(subject[i][j]))
+		}
+		rdns = append(rdns, strings.Join(atvs, "+"))
+	}
+	return strings.Join(rdns, ","), nil
+}
+
+// rawCertificate holds the leading fields of an X.509 certificate, up to
+// the subject.  Everything after it is irrelevant for naming the user.
+type rawCertificate struct {
+	TBSCertificate struct {
+		Version            int "optional,explicit,default:1,tag:0"
+		SerialNumber       asn1.RawValue
+		SignatureAlgorithm asn1.RawValue
+		Issuer             asn1.RawValue
+		Validity           asn1.RawValue
+		Subject            rdnSequence
+	}
+}
+
+type rdnSequence []rdnSET
+
+// The SET suffix makes asn1 handle the type as a SET OF.
+type rdnSET []attributeTypeAndValue
+
+type attributeTypeAndValue struct {
+	Type  asn1.ObjectIdentifier
+	Value asn1.RawValue
+}
+
+// dnAttributeNames holds the names used for the attribute types
+// known to the server when formatting distinguished names.
+var dnAttributeNames = map[string]string{
+	"2.5.4.3":                    "CN",
+	"2.5.4.5":                    "serialNumber",
+	"2.5.4.6":                    "C",
+	"2.5.4.7":                    "L",
+	"2.5.4.8":                    "ST",
+	"2.5.4.9":                    "street",
+	"2.5.4.10":                   "O",
+	"2.5.4.11":                   "OU",
+	"2.5.4.17":                   "postalCode",
+	"0.9.2342.19200300.100.1.1":  "UID",
+	"0.9.2342.19200300.100.1.25": "DC",
+	"1.2.840.113549.1.9.1":       "emailAddress",
+}
+
+// formatDNAttribute formats atv as an RFC 2253 attribute type and value.
+// Values of unknown types, or not encoded as strings, are formatted as
+// the hex encoding of their DER bytes.
+func formatDNAttribute(atv attributeTypeAndValue) string {
+	oid := make([]string, len(atv.Type))
+	for i, n := range atv.Type {
+		oid[i] = strconv.Itoa(n)
+	}
+	name, known := dnAttributeNames[strings.Join(oid, ".")]
+	if !known {
+		name = strings.Join(oid, ".")
+	}
+	if known && atv.Value.Class == 0 {
+		switch atv.Value.Tag {
+		case 12, 19, 20, 22: // UTF8String, PrintableString, T61String, IA5String
+			return name + "=" + escapeDN(string(atv.Value.Bytes))
+		}
+	}
+	return name + "=#" + hex.EncodeToString(atv.Value.FullBytes)
+}
+
+// escapeDN escapes value for use in an RFC 2253 distinguished name.
+func escapeDN(value string) string {
+	buf := make([]byte, 0, len(value))
+	for i := 0; i != len(value); i++ {
+		c := value[i]
+		switch {
+		case c == ',' || c == '+' || c == '"' || c == '\\' || c == '<' || c == '>' || c == ';':
+			buf = append(buf, '\\')
+		case c == '#' && i == 0, c == ' ' && (i == 0 || i == len(value)-1):
+			buf = append(buf, '\\')
+		}
+		buf = append(buf, c)
+	}
+	return string(buf)
+}
+
+func (socket *mongoSocket) loginSASL(auth authInfo) os.Error {
+	sasl, err := newSaslMechanism(auth)
+	if err != nil {
+		return err
+	}
+	payload, _, err := sasl.Step(nil)
+	if err != nil {
+		return err
+	}
+
+	cmd := saslCmd{Start: 1, Mechanism: auth.mechanism, Payload: payload}
+	for {
+		var result saslResult
+		err = socket.loginRun(auth.db, &cmd, &result, func() os.Error {
+			if !result.Ok {
+				return &authError{result.ErrMsg}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		var done bool
+		payload, done, err = sasl.Step(result.Payload)
+		if err != nil {
+			return err
+		}
+		if done && result.Done {
+			break
+		}
+		cmd = saslCmd{Continue: 1, ConversationId: result.ConversationId, Payload: payload}
+	}
+
+	socket.Lock()
+	socket.dropAuth(auth.db)
+	socket.auth = append(socket.auth, auth)
+	socket.Unlock()
+	return nil
+}
+
+// loginRun sends the authentication command cmd to db through the socket,
+// and unmarshals the reply into result.  If f is not nil, it's called with
+// the result within the read loop of the socket, so that concurrent login
+// requests are properly ordered, and its error is returned.
+func (socket *mongoSocket) loginRun(db string, cmd, result interface{}, f func() os.Error) os.Error {
 	var mutex sync.Mutex
 	var replyErr os.Error
 	mutex.Lock()
 
 	op := queryOp{}
-	op.query = &cmd
+	op.query = cmd
 	op.collection = db + ".$cmd"
 	op.limit = -1
 	op.replyFunc = func(err os.Error, reply *replyOp, docNum int, docData []byte) {
@@ -189,34 +526,19 @@ func (socket *mongoSocket) Login(db string, user string, pass string) os.Error {
 			return
 		}
 
-		// Must handle this within the read loop for the socket, so
-		// that concurrent login requests are properly ordered.
-		result := &authResult{}
 		err = bson.Unmarshal(docData, result)
 		if err != nil {
 			replyErr = err
-			return
-		}
-		if !result.Ok {
-			replyErr = os.NewError(result.ErrMsg)
+		} else if f != nil {
+			replyErr = f()
 		}
-
-		socket.Lock()
-		socket.dropAuth(db)
-		socket.auth = append(socket.auth, authInfo{db, user, pass})
-		socket.Unlock()
 	}
 
-	err = socket.Query(&op)
+	err := socket.Query(&op)
 	if err != nil {
 		return err
 	}
 	mutex.Lock() // Wait.
-	if replyErr != nil {
-		debugf("Socket %p to %s: login error: %s", socket, socket.addr, replyErr)
-	} else {
-		debugf("Socket %p to %s: login successful", socket, socket.addr)
-	}
 	return replyErr
 }
 
@@ -268,13 +590,13 @@ func (socket *mongoSocket) dropAuth(db string) (auth authInfo, found bool) {
 	return auth, false
 }
 
-func (socket *mongoSocket) dropLogout(db, user, pass string) (auth authInfo, found bool) {
+func (socket *mongoSocket) dropLogout(auth authInfo) (found bool) {
 	for i, a := range socket.logout {
-		if a.db == db && a.user == user && a.pass == pass {
+		if a.sameAs(auth) {
 			copy(socket.logout[i:], socket.logout[i+1:])
 			socket.logout = socket.logout[:len(socket.logout)-1]
-			return a, true
+			return true
 		}
 	}
-	return auth, false
+	return false
 }
@@ -31,6 +31,7 @@
 package mgo
 
 import (
+	"crypto/tls"
 	"sync"
 	"time"
 	"os"
@@ -55,11 +56,12 @@ type mongoCluster struct {
 	references   int
 	syncing      bool
 	direct       bool
+	tlsConfig    *tls.Config
 	cachedIndex  map[string]bool
 }
 
-func newCluster(userSeeds []string, direct bool) *mongoCluster {
-	cluster := &mongoCluster{userSeeds: userSeeds, references: 1, direct: direct}
+func newCluster(userSeeds []string, direct bool, tlsConfig *tls.Config) *mongoCluster {
+	cluster := &mongoCluster{userSeeds: userSeeds, references: 1, direct: direct, tlsConfig: tlsConfig}
 	cluster.serverSynced.L = cluster.RWMutex.RLocker()
 	go cluster.syncServers()
 	return cluster
@@ -294,7 +296,7 @@ restart:
 				m.Unlock()
 			}()
 
-			server, err := newServer(addr)
+			server, err := newServer(addr, cluster.tlsConfig)
 			if err != nil {
 				log("[sync] Failed to start sync of ", addr, ": ", err.String())
 				return
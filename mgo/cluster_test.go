@@ -74,7 +74,7 @@ func (s *S) TestNewSession(c *C) {
 	err = otherColl.Insert(M{"_id": 2})
 	c.Assert(err, IsNil)
 
-	// Ping the database to ensure the nonce has been received already.
+	// Ping the database to ensure the socket is established already.
 	c.Assert(other.Ping(), IsNil)
 
 	mgo.ResetStats()
@@ -137,7 +137,7 @@ func (s *S) TestCloneSession(c *C) {
 	err = cloneColl.Insert(M{"_id": 2})
 	c.Assert(err, IsNil)
 
-	// Ping the database to ensure the nonce has been received already.
+	// Ping the database to ensure the socket is established already.
 	c.Assert(clone.Ping(), IsNil)
 
 	mgo.ResetStats()
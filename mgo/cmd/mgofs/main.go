@@ -0,0 +1,283 @@
+// mgo - MongoDB driver for Go
+// 
+// Copyright (c) 2010-2011 - Gustavo Niemeyer <gustavo@niemeyer.net>
+// 
+// All rights reserved.
+// 
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// 
+//     * Redistributions of source code must retain the above copyright notice,
+//       this list of conditions and the following disclaimer.
+//     * Redistributions in binary form must reproduce the above copyright notice,
+//       this list of conditions and the following disclaimer in the documentation
+//       and/or other materials provided with the distribution.
+//     * Neither the name of the copyright holder nor the names of its
+//       contributors may be used to endorse or promote products derived from
+//       this software without specific prior written permission.
+// 
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+// The mgofs command manages files stored in a MongoDB GridFS.
+//
+// Usage:
+//
+//     mgofs [flags] put <local file> [<name>]
+//     mgofs [flags] get <name> [<local file>]
+//     mgofs [flags] list
+//     mgofs [flags] stat <name>
+//     mgofs [flags] delete <name>
+//
+// The flags are:
+//
+//     -url       Connection URL, as accepted by mgo.Mongo (localhost)
+//     -db        Database holding the GridFS (test)
+//     -prefix    GridFS prefix (fs)
+//     -type      Content type of files put
+//     -meta      JSON object with the metadata of files put
+//     -filter    JSON query document filtering the files listed
+//
+// The get command writes to the standard output if the local file is "-"
+// or missing.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/CloudMarc/mgo/gobson"
+	"io"
+	"json"
+	"launchpad.net/mgo"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var (
+	url    = flag.String("url", "localhost", "connection URL, as accepted by mgo.Mongo")
+	dbname = flag.String("db", "test", "database holding the GridFS")
+	prefix = flag.String("prefix", "fs", "GridFS prefix")
+	ctype  = flag.String("type", "", "content type of files put")
+	meta   = flag.String("meta", "", "JSON object with the metadata of files put")
+	filter = flag.String("filter", "", "JSON query document filtering the files listed")
+)
+
+// stdout is where the commands write their output.
+var stdout io.Writer = os.Stdout
+
+type command struct {
+	name    string
+	minArgs int
+	maxArgs int
+	run     func(gfs *mgo.GridFS, args []string) os.Error
+}
+
+var commands = []command{
+	{"put", 1, 2, put},
+	{"get", 1, 2, get},
+	{"list", 0, 0, list},
+	{"stat", 1, 1, stat},
+	{"delete", 1, 1, remove},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: mgofs [flags] put|get|list|stat|delete [args]\n\nFlags:\n")
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	args := flag.Args()
+	if len(args) == 0 {
+		usage()
+	}
+	for _, cmd := range commands {
+		if cmd.name != args[0] {
+			continue
+		}
+		args = args[1:]
+		if len(args) < cmd.minArgs || len(args) > cmd.maxArgs {
+			usage()
+		}
+		session, err := mgo.Mongo(*url)
+		if err != nil {
+			fatal(err)
+		}
+		defer session.Close()
+		err = cmd.run(session.DB(*dbname).GridFS(*prefix), args)
+		if err != nil {
+			fatal(err)
+		}
+		return
+	}
+	usage()
+}
+
+func fatal(err os.Error) {
+	fmt.Fprintf(os.Stderr, "mgofs: %s\n", err.String())
+	os.Exit(1)
+}
+
+func parseJSON(flagName, value string) (doc map[string]interface{}, err os.Error) {
+	if value == "" {
+		return nil, nil
+	}
+	err = json.Unmarshal([]byte(value), &doc)
+	if err != nil {
+		return nil, os.NewError("invalid -" + flagName + " value: " + err.String())
+	}
+	return doc, nil
+}
+
+func put(gfs *mgo.GridFS, args []string) (err os.Error) {
+	metadata, err := parseJSON("meta", *meta)
+	if err != nil {
+		return err
+	}
+	local, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer local.Close()
+
+	name := filepath.Base(args[0])
+	if len(args) > 1 {
+		name = args[1]
+	}
+	file, err := gfs.Create(name)
+	if err != nil {
+		return err
+	}
+	file.SetContentType(*ctype)
+	if metadata != nil {
+		file.SetInfo(metadata)
+	}
+	_, err = io.Copy(file, local)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "%s\t%d\t%s\n", name, file.Size(), file.MD5())
+	return nil
+}
+
+func get(gfs *mgo.GridFS, args []string) (err os.Error) {
+	file, err := gfs.Open(args[0])
+	if err != nil {
+		return err
+	}
+
+	out := stdout
+	if len(args) > 1 && args[1] != "-" {
+		local, err := os.Create(args[1])
+		if err != nil {
+			file.Close()
+			return err
+		}
+		defer local.Close()
+		out = local
+	}
+	_, err = io.Copy(out, file)
+	// Close reports corruption detected while reading.
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func list(gfs *mgo.GridFS, args []string) (err os.Error) {
+	query, err := parseJSON("filter", *filter)
+	if err != nil {
+		return err
+	}
+	var q interface{}
+	if query != nil {
+		q = query
+	}
+	iter, err := gfs.Find(q)
+	if err != nil {
+		return err
+	}
+	for {
+		file, err := iter.Next()
+		if err == mgo.NotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		info := file.Stat()
+		file.Close()
+		fmt.Fprintf(stdout, "%s\t%d\t%s\t%s\n", info.Name, info.Length, formatDate(info.UploadDate), info.ContentType)
+	}
+	panic("unreached")
+}
+
+func stat(gfs *mgo.GridFS, args []string) (err os.Error) {
+	file, err := gfs.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info := file.Stat()
+	fmt.Fprintf(stdout, "Id:           %v\n", formatId(info.Id))
+	fmt.Fprintf(stdout, "Name:         %s\n", info.Name)
+	fmt.Fprintf(stdout, "Length:       %d\n", info.Length)
+	fmt.Fprintf(stdout, "Chunk size:   %d\n", info.ChunkSize)
+	fmt.Fprintf(stdout, "MD5:          %s\n", info.MD5)
+	fmt.Fprintf(stdout, "Upload date:  %s\n", formatDate(info.UploadDate))
+	fmt.Fprintf(stdout, "Content type: %s\n", info.ContentType)
+
+	var metadata bson.M
+	err = file.GetInfo(&metadata)
+	if err != nil {
+		return err
+	}
+	if metadata != nil {
+		data, err := json.MarshalIndent(metadata, "", "    ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "Metadata:     %s\n", data)
+	}
+	return nil
+}
+
+func remove(gfs *mgo.GridFS, args []string) os.Error {
+	// Remove succeeds when there's nothing to delete, so look
+	// for the file first to report it as missing.
+	n, err := gfs.Files.Find(bson.M{"filename": args[0]}).Count()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return mgo.NotFound
+	}
+	return gfs.Remove(args[0])
+}
+
+func formatId(id interface{}) interface{} {
+	if oid, ok := id.(bson.ObjectId); ok {
+		return oid.Hex()
+	}
+	return id
+}
+
+func formatDate(nsec int64) string {
+	return time.SecondsToUTC(nsec / 1e9).Format(time.RFC3339)
+}
@@ -0,0 +1,114 @@
+// mgo - MongoDB driver for Go
+// 
+// Copyright (c) 2010-2011 - Gustavo Niemeyer <gustavo@niemeyer.net>
+// 
+// All rights reserved.
+// 
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// 
+//     * Redistributions of source code must retain the above copyright notice,
+//       this list of conditions and the following disclaimer.
+//     * Redistributions in binary form must reproduce the above copyright notice,
+//       this list of conditions and the following disclaimer in the documentation
+//       and/or other materials provided with the distribution.
+//     * Neither the name of the copyright holder nor the names of its
+//       contributors may be used to endorse or promote products derived from
+//       this software without specific prior written permission.
+// 
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	. "launchpad.net/gocheck"
+	"launchpad.net/mgo"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAll(t *testing.T) {
+	TestingT(t)
+}
+
+type S struct {
+	session *mgo.Session
+	gfs     *mgo.GridFS
+	output  bytes.Buffer
+}
+
+var _ = Suite(&S{})
+
+func (s *S) SetUpTest(c *C) {
+	session, err := mgo.Mongo("localhost:40011")
+	c.Assert(err, IsNil)
+	db := session.DB("mgofs")
+	err = db.DropDatabase()
+	c.Assert(err, IsNil)
+	s.session = session
+	s.gfs = db.GridFS("fs")
+	s.output.Reset()
+	stdout = &s.output
+}
+
+func (s *S) TearDownTest(c *C) {
+	stdout = os.Stdout
+	s.session.Close()
+}
+
+func (s *S) TestPutListStatGetDelete(c *C) {
+	dir := c.MkDir()
+	path := filepath.Join(dir, "local.txt")
+	err := ioutil.WriteFile(path, []byte("some data"), 0644)
+	c.Assert(err, IsNil)
+
+	err = put(s.gfs, []string{path, "myfile.txt"})
+	c.Assert(err, IsNil)
+	c.Assert(s.output.String(), Equals, "myfile.txt\t9\t1e50210a0202497fb79bc38b6ade6c34\n")
+
+	s.output.Reset()
+	err = list(s.gfs, nil)
+	c.Assert(err, IsNil)
+	c.Assert(s.output.String(), Matches, "myfile.txt\t9\t[-0-9T:Z]+\t\n")
+
+	// The id is reported in hex, which requires the ObjectId
+	// type to be the one used by mgo.
+	s.output.Reset()
+	err = stat(s.gfs, []string{"myfile.txt"})
+	c.Assert(err, IsNil)
+	c.Assert(s.output.String(), Matches, "(?s)Id:           [0-9a-f]{24}\nName:         myfile.txt\nLength:       9\n.*")
+
+	s.output.Reset()
+	err = get(s.gfs, []string{"myfile.txt"})
+	c.Assert(err, IsNil)
+	c.Assert(s.output.String(), Equals, "some data")
+
+	target := filepath.Join(dir, "copy.txt")
+	err = get(s.gfs, []string{"myfile.txt", target})
+	c.Assert(err, IsNil)
+	data, err := ioutil.ReadFile(target)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "some data")
+
+	err = remove(s.gfs, []string{"myfile.txt"})
+	c.Assert(err, IsNil)
+
+	_, err = s.gfs.Open("myfile.txt")
+	c.Assert(err == mgo.NotFound, Equals, true)
+
+	err = remove(s.gfs, []string{"myfile.txt"})
+	c.Assert(err == mgo.NotFound, Equals, true)
+}
@@ -31,17 +31,28 @@
 package mgo
 
 import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
 	"crypto/md5"
 	"encoding/hex"
+	"fmt"
 	"hash"
+	"io"
+	"io/ioutil"
 	"github.com/CloudMarc/mgo/gobson"
 	"os"
 	"sync"
+	"time"
 )
 
 type GridFS struct {
 	Files  Collection
 	Chunks Collection
+
+	// Compression is the default compression of files created with
+	// Create.  See the SetCompression method of GridFile.
+	Compression string
 }
 
 type gfsFileMode int
@@ -63,11 +74,19 @@ type GridFile struct {
 	offset int64
 
 	wpending int
+	wmax     int
+	werr     *GridWriteError
 	wbuf     []byte
 	wsum     hash.Hash
+	wfirst   int    // First chunk written by this GridFile.
+	wpartial []byte // Original data of the partial chunk being rewritten.
+	wexists  bool   // Whether the files document exists already.
 
-	rbuf   []byte
-	rcache *gfsCachedChunk
+	rbuf      []byte
+	rahead    int
+	rprefetch *gfsPrefetch
+	rsum      hash.Hash // Running MD5 of the chunks read in sequence, or nil.
+	rsumn     int       // Next chunk expected by rsum.
 
 	doc gfsFile
 }
@@ -81,6 +100,7 @@ type gfsFile struct {
 	Filename    string    ",omitempty"
 	ContentType string    "contentType,omitempty"
 	Metadata    *bson.Raw ",omitempty"
+	Compression string    "compression,omitempty"
 }
 
 type gfsChunk struct {
@@ -91,14 +111,21 @@ type gfsChunk struct {
 }
 
 type gfsCachedChunk struct {
-	wait sync.Mutex
 	n    int
 	data []byte
 	err  os.Error
 }
 
+// gfsPrefetch holds the state of the background goroutine which reads
+// chunks ahead of the reading position of a file.
+type gfsPrefetch struct {
+	next   int                  // Chunk expected next out of chunks.
+	chunks chan *gfsCachedChunk // Closed once no more chunks are available.
+	cancel chan bool            // Closed to stop the goroutine.
+}
+
 func newGridFS(db Database, prefix string) *GridFS {
-	return &GridFS{db.C(prefix + ".files"), db.C(prefix + ".chunks")}
+	return &GridFS{Files: db.C(prefix + ".files"), Chunks: db.C(prefix + ".chunks")}
 }
 
 func (gfs GridFS) newFile() *GridFile {
@@ -155,9 +182,201 @@ func (gfs GridFS) Create(name string) (file *GridFile, err os.Error) {
 	file.mode = gfsWriting
 	file.wsum = md5.New()
 	file.doc = gfsFile{Id: bson.NewObjectId(), ChunkSize: 256 * 1024, Filename: name}
+	if gfs.Compression != "" {
+		file.SetCompression(gfs.Compression)
+	}
 	return
 }
 
+// ResumeId resumes writing the file with the provided id, which must have
+// been created with Create and had some of its data written before being
+// interrupted, without being closed.  The data written so far is verified
+// and recovered from the chunks inserted before the interruption, so that
+// writing continues right after it, and the MD5 of the whole file is
+// recorded once it's closed.  Since chunks are inserted concurrently (see
+// SetMaxPending), some of them may be missing after an interruption.  In
+// that case writing continues from the first missing chunk, and the chunks
+// after it are removed, so the data they held must be written again.
+//
+// As the file name, content type and metadata are only recorded when the
+// file is closed, they must be set again on the resumed file if desired.
+// If a single chunk had been written, the chunk size should be set again
+// too, before writing.
+//
+// Files written with compression can't be resumed, since the compression
+// is only recorded when the file is closed.
+//
+// If a file with the provided id exists already, AppendId should be used
+// instead.  If no chunks exist for the id, err is set to mgo.NotFound,
+// and if the first chunk is missing, a *CorruptionError is returned.  In
+// both cases the chunks are left untouched.
+func (gfs GridFS) ResumeId(id interface{}) (file *GridFile, err os.Error) {
+	n, err := gfs.Files.Find(bson.M{"_id": id}).Count()
+	if err != nil {
+		return nil, err
+	}
+	if n > 0 {
+		return nil, os.NewError("GridFS file was already closed; use AppendId to write to it")
+	}
+	file = gfs.newFile()
+	file.mode = gfsWriting
+	file.wsum = md5.New()
+	file.doc = gfsFile{Id: id, ChunkSize: 256 * 1024}
+	err = file.recoverChunks(false)
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// AppendId opens the file with the provided id for writing further data
+// at its end.  The file Length, MD5 and upload date are updated when it's
+// closed, so that readers only see the new data afterwards.  If the file
+// isn't found, err will be set to mgo.NotFound.
+//
+// If the last chunk of the file isn't full, it's updated in place with the
+// data that follows it, so readers going through that chunk while the file
+// is being appended to may find it longer than expected and report the
+// file as corrupted.  The original chunk is restored if writing fails.
+//
+// Note that appending to a file changes it in place, rather than creating
+// a new revision of it as Create does.
+func (gfs GridFS) AppendId(id interface{}) (file *GridFile, err os.Error) {
+	var doc gfsFile
+	err = gfs.Files.Find(bson.M{"_id": id}).One(&doc)
+	if err != nil {
+		return nil, err
+	}
+	return gfs.openAppend(doc)
+}
+
+// Append opens the most recent revision of the file with the provided name
+// for writing further data at its end.  See AppendId for details.
+func (gfs GridFS) Append(name string) (file *GridFile, err os.Error) {
+	var doc gfsFile
+	err = gfs.Files.Find(bson.M{"filename": name}).Sort(bson.M{"uploadDate": -1}).One(&doc)
+	if err != nil {
+		return nil, err
+	}
+	return gfs.openAppend(doc)
+}
+
+func (gfs GridFS) openAppend(doc gfsFile) (*GridFile, os.Error) {
+	file := gfs.newFile()
+	file.mode = gfsWriting
+	file.wsum = md5.New()
+	file.doc = doc
+	file.wexists = true
+	err := file.recoverChunks(true)
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// recoverChunks prepares the file for writing after the chunks already
+// inserted for it.  Full chunks are added to the running MD5, and the data
+// of a trailing partial chunk is buffered so that the chunk is rewritten
+// with the data that follows it.  If known is true, the file document
+// exists and the chunks must match its Length and ChunkSize.  Otherwise
+// they're computed out of the chunks themselves, up to the first missing
+// one, and the chunks after it are removed.
+func (file *GridFile) recoverChunks(known bool) os.Error {
+	var last *gfsChunk
+	var length int64
+	n := 0
+	gap := false
+	full := func(chunk *gfsChunk) os.Error {
+		if len(chunk.Data) != file.doc.ChunkSize {
+			return file.corruption(fmt.Sprintf("chunk %d has %d bytes rather than %d", chunk.N, len(chunk.Data), file.doc.ChunkSize))
+		}
+		file.wsum.Write(chunk.Data)
+		return nil
+	}
+	var chunk *gfsChunk
+	err := file.gfs.Chunks.Find(bson.M{"files_id": file.doc.Id}).Sort(bson.M{"n": 1}).For(&chunk, func() os.Error {
+		if gap {
+			return nil
+		}
+		if chunk.N > n && !known {
+			// Inserts were still pending when writing was interrupted.
+			gap = true
+			return nil
+		}
+		if file.doc.Compression != "" {
+			data, err := decompressChunk(file.doc.Compression, chunk.Data)
+			if err != nil {
+				return file.corruption(fmt.Sprintf("chunk %d can't be decompressed: %s", chunk.N, err.String()))
+			}
+			chunk.Data = data
+		}
+		if chunk.N < n {
+			return file.corruption(fmt.Sprintf("chunk %d is duplicated", chunk.N))
+		}
+		if chunk.N > n {
+			return file.corruption(fmt.Sprintf("chunk %d is missing", n))
+		}
+		if last != nil {
+			// All chunks but the last one must be full.
+			if !known && n == 1 {
+				file.doc.ChunkSize = len(last.Data)
+			}
+			if err := full(last); err != nil {
+				return err
+			}
+		}
+		length += int64(len(chunk.Data))
+		last = chunk
+		n++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if gap && last == nil {
+		// Nothing can be recovered, and the chunks are left alone.
+		return file.corruption("chunk 0 is missing")
+	}
+	if known && length != file.doc.Length {
+		return file.corruption(fmt.Sprintf("chunks hold %d bytes rather than %d", length, file.doc.Length))
+	}
+	if last == nil {
+		if !known {
+			return NotFound
+		}
+		return nil
+	}
+	if !known && n == 1 && len(last.Data) > file.doc.ChunkSize {
+		// A single chunk larger than the default size must be full.
+		file.doc.ChunkSize = len(last.Data)
+	}
+	if len(last.Data) == file.doc.ChunkSize {
+		if err := full(last); err != nil {
+			return err
+		}
+		file.chunk = n
+	} else {
+		if len(last.Data) > file.doc.ChunkSize {
+			return file.corruption(fmt.Sprintf("chunk %d has %d bytes rather than %d", last.N, len(last.Data), file.doc.ChunkSize))
+		}
+		file.wbuf = append(file.wbuf, last.Data...)
+		file.wpartial = last.Data
+		file.chunk = n - 1
+	}
+	if gap {
+		// Only drop the chunks once the ones before them are known good.
+		debugf("GridFile %p: removing chunks after missing chunk %d", file, n)
+		err = file.gfs.Chunks.RemoveAll(bson.M{"files_id": file.doc.Id, "n": bson.M{"$gte": n}})
+		if err != nil {
+			return err
+		}
+	}
+	file.wfirst = file.chunk
+	file.doc.Length = length
+	debugf("GridFile %p: recovered %d bytes in %d chunks", file, length, n)
+	return nil
+}
+
 // OpenId returns a file with the provided id in case it exists or an error
 // instead.  If the file isn't found, err will be set to mgo.NotFound.
 //
@@ -200,10 +419,7 @@ func (gfs GridFS) OpenId(id interface{}) (file *GridFile, err os.Error) {
 	if err != nil {
 		return
 	}
-	file = gfs.newFile()
-	file.mode = gfsReading
-	file.doc = doc
-	return
+	return gfs.openDoc(doc), nil
 }
 
 // Open returns the most recent uploaded file with the provided name, or an
@@ -248,28 +464,53 @@ func (gfs GridFS) Open(name string) (file *GridFile, err os.Error) {
 	if err != nil {
 		return
 	}
-	file = gfs.newFile()
-	file.mode = gfsReading
-	file.doc = doc
-	return
+	return gfs.openDoc(doc), nil
 }
 
-// RemoveId deletes the file with the provided id from the GridFS.
-func (gfs GridFS) RemoveId(id interface{}) os.Error {
-	err := gfs.Files.Remove(bson.M{"_id": id})
+// OpenRevision returns the revision n of the file with the provided name,
+// or an error instead.  Revisions are ordered by upload date, so that 0 is
+// the oldest one, 1 the one after it, and so on.  Negative values count
+// from the most recent revision instead, so that -1 is the most recent
+// revision, as returned by Open, -2 the one before it, and so on.  If the
+// revision isn't found, err will be set to mgo.NotFound.
+func (gfs GridFS) OpenRevision(name string, n int) (file *GridFile, err os.Error) {
+	var doc gfsFile
+	query := gfs.Files.Find(bson.M{"filename": name})
+	if n < 0 {
+		query = query.Sort(bson.M{"uploadDate": -1}).Skip(-n - 1)
+	} else {
+		query = query.Sort(bson.M{"uploadDate": 1}).Skip(n)
+	}
+	err = query.One(&doc)
 	if err != nil {
-		return err
+		return
 	}
-	return gfs.Chunks.RemoveAll(bson.M{"files_id": id})
+	return gfs.openDoc(doc), nil
 }
 
-type gfsDocId struct {
-	Id interface{} "_id"
+// Revisions returns the details of all revisions of the file with the
+// provided name, ordered from the oldest to the most recent one.
+func (gfs GridFS) Revisions(name string) (revisions []*GridFileInfo, err os.Error) {
+	var doc *gfsFile
+	err = gfs.Files.Find(bson.M{"filename": name}).Sort(bson.M{"uploadDate": 1}).For(&doc, func() os.Error {
+		revisions = append(revisions, doc.info())
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return revisions, nil
 }
 
-// Remove deletes all files with the provided name from the GridFS.
-func (gfs GridFS) Remove(name string) (err os.Error) {
-	iter, err := gfs.Files.Find(bson.M{"filename": name}).Select(bson.M{"_id": 1}).Iter()
+// RemoveRevisions deletes all revisions of the file with the provided
+// name except for the keep most recent ones.  With keep set to zero, all
+// revisions are deleted, as done by Remove.
+func (gfs GridFS) RemoveRevisions(name string, keep int) (err os.Error) {
+	if keep < 0 {
+		return os.NewError("RemoveRevisions: keep must not be negative")
+	}
+	query := gfs.Files.Find(bson.M{"filename": name}).Sort(bson.M{"uploadDate": -1}).Skip(keep)
+	iter, err := query.Select(bson.M{"_id": 1}).Iter()
 	if err != nil {
 		return err
 	}
@@ -288,6 +529,153 @@ func (gfs GridFS) Remove(name string) (err os.Error) {
 	return err
 }
 
+func (gfs GridFS) openDoc(doc gfsFile) *GridFile {
+	file := gfs.newFile()
+	file.mode = gfsReading
+	file.doc = doc
+	file.rsum = md5.New()
+	file.rahead = 1
+	return file
+}
+
+// CorruptionError is returned when reading a GridFS file whose chunks
+// are inconsistent with the recorded file details, such as when a chunk
+// is missing, has an unexpected size, or the content doesn't match the
+// recorded MD5.
+type CorruptionError struct {
+	Id     interface{}
+	Name   string
+	Reason string
+}
+
+func (err *CorruptionError) String() string {
+	return fmt.Sprintf("GridFS file %q (id %v) is corrupted: %s", err.Name, err.Id, err.Reason)
+}
+
+// corrupted returns a *CorruptionError for file, and records it to be
+// reported at the end of the file and on Close.
+func (file *GridFile) corrupted(reason string) os.Error {
+	err := file.corruption(reason)
+	if file.err == nil {
+		file.err = err
+	}
+	return err
+}
+
+func (file *GridFile) corruption(reason string) os.Error {
+	return &CorruptionError{Id: file.doc.Id, Name: file.doc.Filename, Reason: reason}
+}
+
+// chunkLen returns the length expected for chunk n of the file, which is
+// not positive if the file has no such chunk.
+func (file *GridFile) chunkLen(n int) int64 {
+	chunkSize := int64(file.doc.ChunkSize)
+	expected := file.doc.Length - int64(n)*chunkSize
+	if expected > chunkSize {
+		expected = chunkSize
+	}
+	return expected
+}
+
+// checkChunk verifies that data has the size expected for chunk n, and
+// adds it to the running MD5 of the file, if n follows the chunks read
+// before it.  Once the last chunk is added, the MD5 is verified.
+func (file *GridFile) checkChunk(n int, data []byte) os.Error {
+	chunkSize := int64(file.doc.ChunkSize)
+	expected := file.chunkLen(n)
+	if expected <= 0 {
+		return file.corrupted(fmt.Sprintf("unexpected chunk %d past the end of the file", n))
+	}
+	if int64(len(data)) != expected {
+		return file.corrupted(fmt.Sprintf("chunk %d has %d bytes rather than %d", n, len(data), expected))
+	}
+	if file.rsum == nil {
+		return nil
+	}
+	if n != file.rsumn {
+		// Chunks were skipped over, so the MD5 can't be verified.
+		file.rsum = nil
+		return nil
+	}
+	file.rsum.Write(data)
+	file.rsumn++
+	if int64(file.rsumn)*chunkSize >= file.doc.Length && file.doc.MD5 != "" {
+		sum := hex.EncodeToString(file.rsum.Sum())
+		file.rsum = nil
+		if sum != file.doc.MD5 {
+			// Reported at the end of the file and on Close.
+			file.corrupted(fmt.Sprintf("content has MD5 %s rather than %s", sum, file.doc.MD5))
+		}
+	}
+	return nil
+}
+
+// GridIter iterates over the files found by the Find method of GridFS.
+type GridIter struct {
+	gfs  GridFS
+	iter *Iter
+}
+
+// Find runs query against the files collection of the GridFS and returns
+// an iterator over the matching files.  The query may refer to any of the
+// fields in the files documents, such as filename, contentType, length,
+// uploadDate, or fields within metadata.  A nil query matches all files.
+//
+// For example:
+//
+//     iter, err := db.GridFS("fs").Find(bson.M{"contentType": "text/plain"})
+//     check(err)
+//     for {
+//         file, err := iter.Next()
+//         if err == mgo.NotFound {
+//             break
+//         }
+//         check(err)
+//         fmt.Println(file.Name(), file.Size())
+//         file.Close()
+//     }
+//
+func (gfs GridFS) Find(query interface{}) (iter *GridIter, err os.Error) {
+	i, err := gfs.Files.Find(query).Iter()
+	if err != nil {
+		return nil, err
+	}
+	return &GridIter{gfs, i}, nil
+}
+
+// Next returns the next file found, opened for reading.  Once no more
+// files are available, err is set to mgo.NotFound.
+//
+// As with any other open file, the returned file should be closed once
+// it's not needed anymore.
+func (iter *GridIter) Next() (file *GridFile, err os.Error) {
+	var doc gfsFile
+	err = iter.iter.Next(&doc)
+	if err != nil {
+		return nil, err
+	}
+	return iter.gfs.openDoc(doc), nil
+}
+
+// RemoveId deletes the file with the provided id from the GridFS.
+func (gfs GridFS) RemoveId(id interface{}) os.Error {
+	err := gfs.Files.Remove(bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+	return gfs.Chunks.RemoveAll(bson.M{"files_id": id})
+}
+
+type gfsDocId struct {
+	Id interface{} "_id"
+}
+
+// Remove deletes all files with the provided name from the GridFS.
+// See RemoveRevisions for deleting only older revisions of the file.
+func (gfs GridFS) Remove(name string) (err os.Error) {
+	return gfs.RemoveRevisions(name, 0)
+}
+
 func (file *GridFile) assertMode(mode gfsFileMode) {
 	switch file.mode {
 	case mode:
@@ -317,6 +705,46 @@ func (file *GridFile) SetChunkSize(bytes int) {
 	file.m.Unlock()
 }
 
+// SetMaxPending sets the maximum number of chunks being inserted
+// concurrently in the background while the file is written to.  Once the
+// limit is reached, Write blocks until one of the pending inserts is done.
+// By default, up to 1MB worth of chunks may be pending, and at least one.
+//
+// It is a runtime error to call this function when the file is not open
+// for writing.
+func (file *GridFile) SetMaxPending(chunks int) {
+	file.assertMode(gfsWriting)
+	file.m.Lock()
+	file.wmax = chunks
+	file.m.Unlock()
+}
+
+func (file *GridFile) maxPending() int {
+	if file.wmax > 0 {
+		return file.wmax
+	}
+	if n := 1024 * 1024 / file.doc.ChunkSize; n > 1 {
+		return n
+	}
+	return 1
+}
+
+// GridWriteError reports the failure to insert some of the chunks of a
+// GridFS file being written.  Once a chunk fails, no further chunks are
+// inserted, but the ones already pending are waited for and any other
+// failures are also reported.
+type GridWriteError struct {
+	Chunks []int      // Numbers of the chunks which failed to be inserted.
+	Errors []os.Error // Errors for the respective chunks.
+}
+
+func (err *GridWriteError) String() string {
+	if len(err.Chunks) == 1 {
+		return fmt.Sprintf("GridFS chunk %d insert failed: %s", err.Chunks[0], err.Errors[0].String())
+	}
+	return fmt.Sprintf("GridFS insert failed for %d chunks, first chunk %d: %s", len(err.Chunks), err.Chunks[0], err.Errors[0].String())
+}
+
 // Id returns the current file Id.
 func (file *GridFile) Id() interface{} {
 	return file.doc.Id
@@ -369,6 +797,36 @@ func (file *GridFile) SetContentType(ctype string) {
 	file.m.Unlock()
 }
 
+// SetCompression sets the compression applied to the chunks of the file
+// when they're written, which may be "gzip" or "flate", or empty for no
+// compression.  Each chunk is compressed on its own, and the compression
+// is recorded in the file document, so that reading, seeking, and serving
+// the file decompress it transparently.  The file size, the chunk size,
+// and the MD5 all refer to the uncompressed content.
+//
+// It is a runtime error to call this function when the file is not open
+// for writing, and an error is reported if the compression is unknown or
+// if the file was open with Append or AppendId with a different one.
+func (file *GridFile) SetCompression(compression string) {
+	file.assertMode(gfsWriting)
+	file.m.Lock()
+	defer file.m.Unlock()
+	var err os.Error
+	switch {
+	case compression != "" && compression != "gzip" && compression != "flate":
+		err = os.NewError("Unsupported GridFS compression: " + compression)
+	case (file.wexists || file.chunk > 0) && compression != file.doc.Compression:
+		err = os.NewError("Can't change the compression of GridFS files after writing to them")
+	}
+	if err != nil {
+		if file.err == nil {
+			file.err = err
+		}
+		return
+	}
+	file.doc.Compression = compression
+}
+
 // GetInfo unmarshals the optional metadata associated with the file
 // into the result parameter.  For example:
 //
@@ -425,24 +883,63 @@ func (file *GridFile) UploadDate() int64 {
 	return int64(file.doc.UploadDate)
 }
 
+// GridFileInfo holds the details recorded for a file stored in GridFS,
+// as returned by the Stat method of GridFile.
+type GridFileInfo struct {
+	Id          interface{}
+	Name        string
+	Length      int64
+	ChunkSize   int
+	MD5         string // Hex-encoded, as returned by MD5.
+	UploadDate  int64  // In nanoseconds since the epoch.
+	ContentType string
+	Metadata    *bson.Raw // See GetInfo.
+	Compression string    // See SetCompression.
+}
+
+// Stat returns the details recorded for file.  For a file open for
+// writing, the MD5 and upload date are only known once it's closed.
+func (file *GridFile) Stat() *GridFileInfo {
+	file.m.Lock()
+	defer file.m.Unlock()
+	return file.doc.info()
+}
+
+func (doc *gfsFile) info() *GridFileInfo {
+	return &GridFileInfo{
+		Id:          doc.Id,
+		Name:        doc.Filename,
+		Length:      doc.Length,
+		ChunkSize:   doc.ChunkSize,
+		MD5:         doc.MD5,
+		UploadDate:  int64(doc.UploadDate),
+		ContentType: doc.ContentType,
+		Metadata:    doc.Metadata,
+		Compression: doc.Compression,
+	}
+}
+
 // Close flushes any pending changes in case the file is being written
 // to, waits for any background operations to finish, and closes the file.
 //
 // It's important to Close files whether they are being written to
 // or read from, and to check the err result to ensure the operation
-// completed successfully.
+// completed successfully.  If writing the file fails, any chunks already
+// inserted are removed before Close returns.
 func (file *GridFile) Close() (err os.Error) {
 	file.m.Lock()
 	defer file.m.Unlock()
 	if file.mode == gfsWriting {
-		if len(file.wbuf) > 0 {
+		if len(file.wbuf) > 0 && file.err == nil {
 			file.insertChunk(file.wbuf)
 			file.wbuf = file.wbuf[0:0]
 		}
 		file.insertFile()
-	} else if file.mode == gfsReading && file.rcache != nil {
-		file.rcache.wait.Lock()
-		file.rcache = nil
+		if file.err != nil {
+			file.removeChunks()
+		}
+	} else if file.mode == gfsReading {
+		file.stopPrefetch()
 	}
 	file.mode = gfsClosed
 	debugf("GridFile %p: closed", file)
@@ -511,8 +1008,17 @@ func (file *GridFile) insertChunk(data []byte) {
 	debugf("GridFile %p: adding to checksum: %q", file, string(data))
 	file.wsum.Write(data)
 
-	for file.doc.ChunkSize*file.wpending >= 1024*1024 {
-		// Hold on.. we got a MB pending.
+	if file.doc.Compression != "" {
+		var err os.Error
+		data, err = compressChunk(file.doc.Compression, data)
+		if err != nil {
+			file.err = err
+			return
+		}
+	}
+
+	for file.wpending >= file.maxPending() {
+		// Hold on.. too many chunks pending.
 		file.c.Wait()
 		if file.err != nil {
 			return
@@ -525,24 +1031,78 @@ func (file *GridFile) insertChunk(data []byte) {
 
 	// We may not own the memory of data, so rather than
 	// simply copying it, we'll marshal the document ahead of time.
-	data, err := bson.Marshal(gfsChunk{bson.NewObjectId(), file.doc.Id, n, data})
+	// A partial chunk left by a previous writer is updated in place,
+	// so that there's never more than one chunk with the same n.
+	rewrite := n == file.wfirst && file.wpartial != nil
+	var err os.Error
+	if rewrite {
+		data, err = bson.Marshal(bson.M{"$set": bson.M{"data": data}})
+	} else {
+		data, err = bson.Marshal(gfsChunk{bson.NewObjectId(), file.doc.Id, n, data})
+	}
 	if err != nil {
 		file.err = err
 		return
 	}
 
 	go func() {
-		err := file.gfs.Chunks.Insert(bson.Raw{Data: data})
+		var err os.Error
+		if rewrite {
+			err = file.gfs.Chunks.Update(bson.M{"files_id": file.doc.Id, "n": n}, bson.Raw{Data: data})
+		} else {
+			err = file.gfs.Chunks.Insert(bson.Raw{Data: data})
+		}
 		file.m.Lock()
 		file.wpending--
-		if err != nil && file.err == nil {
-			file.err = err
+		if err != nil {
+			debugf("GridFile %p: failed to insert chunk %d: %s", file, n, err)
+			if file.werr == nil {
+				file.werr = &GridWriteError{}
+				if file.err == nil {
+					file.err = file.werr
+				}
+			}
+			file.werr.Chunks = append(file.werr.Chunks, n)
+			file.werr.Errors = append(file.werr.Errors, err)
 		}
 		file.c.Broadcast()
 		file.m.Unlock()
 	}()
 }
 
+// removeChunks removes all chunks inserted for the file, so that a failed
+// write doesn't leave orphan chunks behind.  Chunks written before the file
+// was resumed or appended to are preserved, and a partial chunk rewritten
+// is restored.  It must be called only once no inserts are pending.
+func (file *GridFile) removeChunks() {
+	debugf("GridFile %p: removing chunks after failure: %s", file, file.err)
+	first := file.wfirst
+	if file.wpartial != nil {
+		data := file.wpartial
+		if file.doc.Compression != "" {
+			var err os.Error
+			data, err = compressChunk(file.doc.Compression, data)
+			if err != nil {
+				logf("GridFile %p: failed to restore partial chunk: %s", file, err)
+				return
+			}
+		}
+		err := file.gfs.Chunks.Update(bson.M{"files_id": file.doc.Id, "n": first}, bson.M{"$set": bson.M{"data": data}})
+		if err != nil {
+			logf("GridFile %p: failed to restore partial chunk: %s", file, err)
+		}
+		first++
+	}
+	selector := bson.M{"files_id": file.doc.Id}
+	if first > 0 {
+		selector["n"] = bson.M{"$gte": first}
+	}
+	err := file.gfs.Chunks.RemoveAll(selector)
+	if err != nil {
+		logf("GridFile %p: failed to remove chunks after failure: %s", file, err)
+	}
+}
+
 func (file *GridFile) insertFile() {
 	hexsum := hex.EncodeToString(file.wsum.Sum())
 	for file.wpending > 0 {
@@ -552,7 +1112,11 @@ func (file *GridFile) insertFile() {
 	if file.err == nil {
 		file.doc.UploadDate = bson.Now()
 		file.doc.MD5 = hexsum
-		file.err = file.gfs.Files.Insert(file.doc)
+		if file.wexists {
+			file.err = file.gfs.Files.Update(bson.M{"_id": file.doc.Id}, file.doc)
+		} else {
+			file.err = file.gfs.Files.Insert(file.doc)
+		}
 		file.gfs.Chunks.EnsureIndexKey([]string{"files_id", "n"})
 	}
 }
@@ -587,6 +1151,11 @@ func (file *GridFile) Seek(offset int64, whence int) (pos int64, err os.Error) {
 	file.offset = offset
 	file.chunk = chunk
 	file.rbuf = nil
+	if offset == file.doc.Length {
+		// There's no chunk at the end of the file to be fetched.
+		file.stopPrefetch()
+		return file.offset, nil
+	}
 	file.rbuf, err = file.getChunk()
 	if err == nil {
 		file.rbuf = file.rbuf[int(file.offset-int64(chunk)*int64(file.doc.ChunkSize)):]
@@ -607,6 +1176,9 @@ func (file *GridFile) Read(b []byte) (n int, err os.Error) {
 	debugf("GridFile %p: reading at offset %d into buffer of length %d", file, file.offset, len(b))
 	defer file.m.Unlock()
 	if file.offset == file.doc.Length {
+		if file.err != nil {
+			return 0, file.err
+		}
 		return 0, os.EOF
 	}
 	for err == nil {
@@ -623,37 +1195,483 @@ func (file *GridFile) Read(b []byte) (n int, err os.Error) {
 	return n, err
 }
 
+// SetReadAhead sets the number of chunks to read in the background ahead
+// of the current position of the file, so that sequential reads aren't
+// held by the latency of retrieving each chunk.  The chunks are obtained
+// through a single query sorted by chunk number.  At most about twice as
+// many chunks as requested, plus one, are held in memory at once.  The default
+// read-ahead window is a single chunk, and zero disables it.
+//
+// Seeking to a position outside of the current chunk discards the chunks
+// read ahead, as does closing the file.
+//
+// It is a runtime error to call this function when the file is not open
+// for reading.
+func (file *GridFile) SetReadAhead(chunks int) {
+	file.assertMode(gfsReading)
+	if chunks < 0 {
+		chunks = 0
+	}
+	file.m.Lock()
+	file.rahead = chunks
+	file.stopPrefetch()
+	file.m.Unlock()
+}
+
 func (file *GridFile) getChunk() (data []byte, err os.Error) {
-	cache := file.rcache
-	file.rcache = nil
-	if cache != nil && cache.n == file.chunk {
-		debugf("GridFile %p: Getting chunk %d from cache", file, file.chunk)
-		cache.wait.Lock()
-		data, err = cache.data, cache.err
+	n := file.chunk
+	if file.rprefetch != nil && file.rprefetch.next != n {
+		debugf("GridFile %p: Discarding chunks read ahead of chunk %d", file, n)
+		file.stopPrefetch()
+	}
+	if file.rprefetch == nil && file.rahead > 0 {
+		file.startPrefetch(n)
+	}
+	if file.rprefetch != nil {
+		debugf("GridFile %p: Getting chunk %d from read-ahead window", file, n)
+		cache, ok := <-file.rprefetch.chunks
+		file.rprefetch.next++
+		if !ok {
+			err = NotFound
+		} else if cache.err != nil {
+			err = cache.err
+		} else if cache.n != n {
+			err = NotFound
+		} else {
+			data = cache.data
+		}
+		if err != nil {
+			file.stopPrefetch()
+		}
 	} else {
-		debugf("GridFile %p: Fetching chunk %d", file, file.chunk)
+		debugf("GridFile %p: Fetching chunk %d", file, n)
 		var doc gfsChunk
-		err = file.gfs.Chunks.Find(bson.D{{"files_id", file.doc.Id}, {"n", file.chunk}}).One(&doc)
+		err = file.gfs.Chunks.Find(bson.D{{"files_id", file.doc.Id}, {"n", n}}).One(&doc)
 		data = doc.Data
 	}
-	file.chunk++
-	if int64(file.chunk)*int64(file.doc.ChunkSize) < file.doc.Length {
-		// Read the next one in background.
-		cache = &gfsCachedChunk{n: file.chunk}
-		cache.wait.Lock()
-		debugf("GridFile %p: Scheduling chunk %d for background caching", file, file.chunk)
-		chunks := file.gfs.Chunks
-		// Clone the session to avoid having it closed in between.
-		chunks.DB.Session = chunks.DB.Session.Clone()
-		go func(id interface{}, n int) {
-			defer chunks.DB.Session.Close()
-			var doc gfsChunk
-			cache.err = chunks.Find(bson.D{{"files_id", id}, {"n", n}}).One(&doc)
-			cache.data = doc.Data
-			cache.wait.Unlock()
-		}(file.doc.Id, file.chunk)
-		file.rcache = cache
+	if err == NotFound {
+		err = file.corrupted(fmt.Sprintf("chunk %d is missing", n))
+	} else if err == nil && file.doc.Compression != "" {
+		data, err = decompressChunk(file.doc.Compression, data)
+		if err != nil {
+			err = file.corrupted(fmt.Sprintf("chunk %d can't be decompressed: %s", n, err.String()))
+		}
+	}
+	if err == nil {
+		err = file.checkChunk(n, data)
 	}
+	file.chunk++
 	debugf("Returning err: %#v", err)
 	return
 }
+
+// startPrefetch starts reading chunks from n onwards in the background,
+// holding up to file.rahead of them until they're requested.
+func (file *GridFile) startPrefetch(n int) {
+	last := int((file.doc.Length - 1) / int64(file.doc.ChunkSize))
+	if n >= last {
+		// Nothing to read ahead of n.
+		return
+	}
+	debugf("GridFile %p: Reading ahead chunks %d to %d, %d at a time", file, n, last, file.rahead)
+	prefetch := &gfsPrefetch{
+		next:   n,
+		chunks: make(chan *gfsCachedChunk, file.rahead),
+		cancel: make(chan bool),
+	}
+	chunks := file.gfs.Chunks
+	// Clone the session to avoid having it closed in between.
+	chunks.DB.Session = chunks.DB.Session.Clone()
+	query := chunks.Find(bson.D{{"files_id", file.doc.Id}, {"n", bson.D{{"$gte", n}, {"$lte", last}}}})
+	// The read-ahead window is enforced by the capacity of the channel
+	// alone.  The batch must hold at least two documents, since asking
+	// for a single one makes the server close the cursor right away.
+	query = query.Sort(bson.M{"n": 1}).Batch(file.rahead + 1).Prefetch(0)
+	go func() {
+		defer chunks.DB.Session.Close()
+		defer close(prefetch.chunks)
+		iter, err := query.Iter()
+		if err == nil {
+			// Chunks left unread when cancelled keep the cursor open.
+			defer iter.Close()
+		}
+		for {
+			var doc gfsChunk
+			if err == nil {
+				err = iter.Next(&doc)
+			}
+			if err == NotFound {
+				return
+			}
+			select {
+			case prefetch.chunks <- &gfsCachedChunk{doc.N, doc.Data, err}:
+			case <-prefetch.cancel:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	file.rprefetch = prefetch
+}
+
+// stopPrefetch discards any chunks read ahead and stops reading more.
+func (file *GridFile) stopPrefetch() {
+	if file.rprefetch != nil {
+		close(file.rprefetch.cancel)
+		file.rprefetch = nil
+	}
+}
+
+// ReadAt reads len(b) bytes from the file starting at offset off, and
+// returns the number of bytes read and an error in case something wrong
+// happened.  When fewer than len(b) bytes are read, err is non-nil, and
+// it is os.EOF if the end of the file was reached.
+//
+// Only the chunks covering the requested range are retrieved, through a
+// single query.  ReadAt doesn't affect nor is affected by the position
+// used by Read and Seek, and it may be called concurrently from multiple
+// goroutines, which makes it suitable for serving ranges of the file to
+// many clients at once.
+//
+// The parameters and behavior of this function turn the file
+// into an io.ReaderAt.
+func (file *GridFile) ReadAt(b []byte, off int64) (n int, err os.Error) {
+	// Close may run concurrently, so check the mode under the lock.
+	func() {
+		file.m.Lock()
+		defer file.m.Unlock()
+		file.assertMode(gfsReading)
+	}()
+	if off < 0 {
+		return 0, os.NewError("GridFile.ReadAt: negative offset")
+	}
+	length := file.doc.Length // The document never changes while reading.
+	if off >= length {
+		return 0, os.EOF
+	}
+	end := off + int64(len(b))
+	if end > length {
+		end = length
+	}
+	if end == off {
+		return 0, nil
+	}
+	chunkSize := int64(file.doc.ChunkSize)
+	first := int(off / chunkSize)
+	last := int((end - 1) / chunkSize)
+	debugf("GridFile %p: reading %d bytes at offset %d from chunks %d to %d", file, end-off, off, first, last)
+
+	query := file.gfs.Chunks.Find(bson.D{{"files_id", file.doc.Id}, {"n", bson.D{{"$gte", first}, {"$lte", last}}}})
+	iter, err := query.Sort(bson.M{"n": 1}).Iter()
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		// Drain the iterator when returning early, so that its
+		// cursor isn't left open in the server.
+		var doc gfsChunk
+		for iter.Next(&doc) == nil {
+		}
+	}()
+	for want := first; want <= last; want++ {
+		var doc gfsChunk
+		err = iter.Next(&doc)
+		if err == NotFound || err == nil && doc.N != want {
+			return n, file.corruption(fmt.Sprintf("chunk %d is missing", want))
+		}
+		if err != nil {
+			return n, err
+		}
+		if file.doc.Compression != "" {
+			doc.Data, err = decompressChunk(file.doc.Compression, doc.Data)
+			if err != nil {
+				return n, file.corruption(fmt.Sprintf("chunk %d can't be decompressed: %s", want, err.String()))
+			}
+		}
+		if expected := file.chunkLen(want); int64(len(doc.Data)) != expected {
+			return n, file.corruption(fmt.Sprintf("chunk %d has %d bytes rather than %d", want, len(doc.Data), expected))
+		}
+		data := doc.Data
+		if want == first {
+			data = data[off-int64(first)*chunkSize:]
+		}
+		n += copy(b[n:], data)
+	}
+	if n < len(b) {
+		return n, os.EOF
+	}
+	return n, nil
+}
+
+// GridFsckProblem describes a file found to be inconsistent by Fsck.
+type GridFsckProblem struct {
+	Id     interface{}
+	Name   string
+	Reason string
+}
+
+// GridFsckReport holds the outcome of running Fsck on a GridFS.
+type GridFsckReport struct {
+	Files  int // Number of files checked.
+	Chunks int // Number of chunks checked.
+
+	// Orphans holds the files_id values of chunks which have no
+	// respective file, and OrphanChunks the number of such chunks.
+	Orphans      []interface{}
+	OrphanChunks int
+
+	// Incomplete holds the files with missing, extra, or wrongly
+	// sized chunks, and Corrupt the files whose chunks are complete
+	// but don't match the recorded length or MD5.
+	Incomplete []GridFsckProblem
+	Corrupt    []GridFsckProblem
+
+	// Repaired is true if the orphans and incomplete files found were
+	// removed.  Corrupt files are never changed.
+	Repaired bool
+}
+
+// Fsck checks the consistency of the GridFS, looking for chunks with no
+// respective file, which are left behind when a writer crashes or when
+// a removal is interrupted, and for files whose chunks are missing or
+// don't match the recorded length and MD5.
+//
+// Chunks are only considered orphans once they're older than grace, in
+// nanoseconds, and files with chunks more recent than that aren't reported
+// as incomplete or corrupt, so that files still being written or appended
+// to aren't affected.  The age of chunks is obtained from their ObjectId,
+// and chunks with other kinds of ids are considered old enough.
+//
+// If repair is true, orphan chunks are removed, and so are incomplete
+// files, since they can't be read back.  Corrupt files have all of their
+// data in place, so they're only reported, and left for the application
+// to recover.  Each problem is verified again right before being repaired,
+// and it's left alone if it's gone by then, as happens when a file being
+// written is closed in the meantime.  Otherwise the GridFS is left
+// untouched.
+func (gfs GridFS) Fsck(grace int64, repair bool) (report *GridFsckReport, err os.Error) {
+	report = &GridFsckReport{}
+	known := make(map[string]bool)
+	limit := time.Seconds() - grace/1e9
+
+	var doc *gfsFile
+	err = gfs.Files.Find(nil).For(&doc, func() os.Error {
+		report.Files++
+		known[gfsIdKey(doc.Id)] = true
+		incomplete, reason, err := gfs.fsckFile(doc, limit, report)
+		if err != nil {
+			return err
+		}
+		if reason != "" {
+			problem := GridFsckProblem{doc.Id, doc.Filename, reason}
+			if incomplete {
+				report.Incomplete = append(report.Incomplete, problem)
+			} else {
+				report.Corrupt = append(report.Corrupt, problem)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	orphans := make(map[string]int)
+	var chunk *struct {
+		Id      interface{} "_id"
+		FilesId interface{} "files_id"
+	}
+	err = gfs.Chunks.Find(nil).Select(bson.M{"_id": 1, "files_id": 1}).For(&chunk, func() os.Error {
+		key := gfsIdKey(chunk.FilesId)
+		if known[key] {
+			return nil
+		}
+		if oid, ok := chunk.Id.(bson.ObjectId); ok && int64(oid.Timestamp()) > limit {
+			return nil
+		}
+		report.OrphanChunks++
+		if orphans[key] == 0 {
+			report.Orphans = append(report.Orphans, chunk.FilesId)
+		}
+		orphans[key]++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if !repair {
+		return report, nil
+	}
+	var ids []interface{}
+	for _, id := range report.Orphans {
+		// The file may have been closed since it was looked for.
+		n, err := gfs.Files.Find(bson.M{"_id": id}).Count()
+		if err != nil {
+			return report, err
+		}
+		if n > 0 {
+			report.OrphanChunks -= orphans[gfsIdKey(id)]
+			continue
+		}
+		ids = append(ids, id)
+		err = gfs.Chunks.RemoveAll(bson.M{"files_id": id})
+		if err != nil {
+			return report, err
+		}
+	}
+	report.Orphans = ids
+	report.Incomplete, err = gfs.fsckRepair(report.Incomplete, limit)
+	if err != nil {
+		return report, err
+	}
+	report.Repaired = true
+	return report, nil
+}
+
+// fsckRepair removes the incomplete files with the given problems, after
+// verifying them again, and returns the problems which were still there.
+func (gfs GridFS) fsckRepair(problems []GridFsckProblem, limit int64) (repaired []GridFsckProblem, err os.Error) {
+	for _, problem := range problems {
+		var doc gfsFile
+		err = gfs.Files.Find(bson.M{"_id": problem.Id}).One(&doc)
+		if err == NotFound {
+			continue
+		}
+		if err != nil {
+			return repaired, err
+		}
+		incomplete, reason, err := gfs.fsckFile(&doc, limit, &GridFsckReport{})
+		if err != nil {
+			return repaired, err
+		}
+		if !incomplete {
+			continue
+		}
+		err = gfs.RemoveId(problem.Id)
+		if err != nil && err != NotFound {
+			return repaired, err
+		}
+		repaired = append(repaired, GridFsckProblem{doc.Id, doc.Filename, reason})
+	}
+	return repaired, nil
+}
+
+// fsckFile verifies the chunks of the file described by doc.  If a problem
+// is found, reason describes it, and incomplete tells whether the chunks
+// themselves are inconsistent, rather than their content.  Problems aren't
+// reported for files with chunks inserted after limit, in seconds, since
+// they may still be being written.
+func (gfs GridFS) fsckFile(doc *gfsFile, limit int64, report *GridFsckReport) (incomplete bool, reason string, err os.Error) {
+	file := &GridFile{doc: *doc}
+	sum := md5.New()
+	n := 0
+	recent := false
+	var chunk *gfsChunk
+	err = gfs.Chunks.Find(bson.M{"files_id": doc.Id}).Sort(bson.M{"n": 1}).For(&chunk, func() os.Error {
+		report.Chunks++
+		if oid, ok := chunk.Id.(bson.ObjectId); ok && int64(oid.Timestamp()) > limit {
+			recent = true
+		}
+		if reason != "" {
+			return nil
+		}
+		if chunk.N != n {
+			if chunk.N < n {
+				reason = fmt.Sprintf("chunk %d is duplicated", chunk.N)
+			} else {
+				reason = fmt.Sprintf("chunk %d is missing", n)
+			}
+			return nil
+		}
+		if doc.Compression != "" {
+			data, err := decompressChunk(doc.Compression, chunk.Data)
+			if err != nil {
+				reason = fmt.Sprintf("chunk %d can't be decompressed: %s", n, err.String())
+				return nil
+			}
+			chunk.Data = data
+		}
+		if expected := file.chunkLen(n); int64(len(chunk.Data)) != expected {
+			if expected <= 0 {
+				reason = fmt.Sprintf("unexpected chunk %d past the end of the file", n)
+			} else {
+				reason = fmt.Sprintf("chunk %d has %d bytes rather than %d", n, len(chunk.Data), expected)
+			}
+			return nil
+		}
+		sum.Write(chunk.Data)
+		n++
+		return nil
+	})
+	if err != nil || recent {
+		return false, "", err
+	}
+	if reason != "" {
+		return true, reason, nil
+	}
+	if file.chunkLen(n) > 0 {
+		return true, fmt.Sprintf("chunk %d is missing", n), nil
+	}
+	if doc.MD5 != "" {
+		if hexsum := hex.EncodeToString(sum.Sum()); hexsum != doc.MD5 {
+			return false, fmt.Sprintf("content has MD5 %s rather than %s", hexsum, doc.MD5), nil
+		}
+	}
+	return false, "", nil
+}
+
+// gfsIdKey returns a string uniquely identifying the file id.
+func gfsIdKey(id interface{}) string {
+	data, err := bson.Marshal(bson.D{{"_id", id}})
+	if err != nil {
+		return fmt.Sprintf("%#v", id)
+	}
+	return string(data)
+}
+
+// compressChunk returns data compressed with the given compression.
+func compressChunk(compression string, data []byte) ([]byte, os.Error) {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch compression {
+	case "gzip":
+		gw, err := gzip.NewWriter(&buf)
+		if err != nil {
+			return nil, err
+		}
+		w = gw
+	case "flate":
+		w = flate.NewWriter(&buf, flate.DefaultCompression)
+	default:
+		return nil, os.NewError("Unsupported GridFS compression: " + compression)
+	}
+	_, err := w.Write(data)
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decompressChunk returns data decompressed with the given compression.
+func decompressChunk(compression string, data []byte) ([]byte, os.Error) {
+	var r io.Reader
+	switch compression {
+	case "gzip":
+		gr, err := gzip.NewReader(bytes.NewBuffer(data))
+		if err != nil {
+			return nil, err
+		}
+		r = gr
+	case "flate":
+		r = flate.NewReader(bytes.NewBuffer(data))
+	default:
+		return nil, os.NewError("Unsupported GridFS compression: " + compression)
+	}
+	return ioutil.ReadAll(r)
+}
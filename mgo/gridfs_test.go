@@ -35,7 +35,11 @@ import (
 	"github.com/CloudMarc/mgo/gobson"
 	. "launchpad.net/gocheck"
 	"github.com/CloudMarc/mgo/mgo"
+	"http"
+	"http/httptest"
+	"io"
 	"os"
+	"strconv"
 	"time"
 )
 
@@ -484,6 +488,57 @@ func (s *S) TestGridFSSeek(c *C) {
 	c.Assert(o, Equals, int64(3))
 }
 
+func (s *S) TestGridFSSeekToEnd(c *C) {
+	session, err := mgo.Mongo("localhost:40011")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	db := session.DB("mydb")
+
+	gfs := db.GridFS("fs")
+	file, err := gfs.Create("")
+	c.Assert(err, IsNil)
+	id := file.Id()
+	file.SetChunkSize(5)
+	file.Write([]byte("abcdefghij"))
+	err = file.Close()
+	c.Assert(err, IsNil)
+
+	b := make([]byte, 5)
+
+	file, err = gfs.OpenId(id)
+	c.Assert(err, IsNil)
+	o, err := file.Seek(0, os.SEEK_END)
+	c.Assert(err, IsNil)
+	c.Assert(o, Equals, int64(10))
+	_, err = file.Read(b)
+	c.Assert(err, Equals, os.EOF)
+
+	// Seeking back must still work.
+	o, err = file.Seek(5, os.SEEK_SET)
+	c.Assert(err, IsNil)
+	c.Assert(o, Equals, int64(5))
+	_, err = file.Read(b)
+	c.Assert(err, IsNil)
+	c.Assert(b, Equals, []byte("fghij"))
+	c.Assert(file.Close(), IsNil)
+
+	// An empty file has no chunks at all.
+	file, err = gfs.Create("")
+	c.Assert(err, IsNil)
+	err = file.Close()
+	c.Assert(err, IsNil)
+
+	file, err = gfs.OpenId(file.Id())
+	c.Assert(err, IsNil)
+	o, err = file.Seek(0, os.SEEK_SET)
+	c.Assert(err, IsNil)
+	c.Assert(o, Equals, int64(0))
+	_, err = file.Read(b)
+	c.Assert(err, Equals, os.EOF)
+	c.Assert(file.Close(), IsNil)
+}
+
 func (s *S) TestGridFSRemoveId(c *C) {
 	session, err := mgo.Mongo("localhost:40011")
 	c.Assert(err, IsNil)
@@ -551,3 +606,1155 @@ func (s *S) TestGridFSRemove(c *C) {
 	c.Assert(err, IsNil)
 	c.Assert(n, Equals, 0)
 }
+
+func (s *S) TestGridFSFind(c *C) {
+	session, err := mgo.Mongo("localhost:40011")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	db := session.DB("mydb")
+
+	gfs := db.GridFS("fs")
+
+	for _, name := range []string{"a.txt", "b.txt", "c.bin"} {
+		file, err := gfs.Create(name)
+		c.Assert(err, IsNil)
+		if name == "c.bin" {
+			file.SetContentType("application/octet-stream")
+		} else {
+			file.SetContentType("text/plain")
+		}
+		file.Write([]byte(name))
+		err = file.Close()
+		c.Assert(err, IsNil)
+	}
+
+	iter, err := gfs.Find(M{"contentType": "text/plain"})
+	c.Assert(err, IsNil)
+
+	var names []string
+	for {
+		file, err := iter.Next()
+		if err == mgo.NotFound {
+			break
+		}
+		c.Assert(err, IsNil)
+		names = append(names, file.Name())
+
+		// Files are open for reading.
+		b := make([]byte, 10)
+		n, err := file.Read(b)
+		c.Assert(err, IsNil)
+		c.Assert(string(b[:n]), Equals, file.Name())
+		c.Assert(file.Close(), IsNil)
+	}
+	c.Assert(names, Equals, []string{"a.txt", "b.txt"})
+
+	iter, err = gfs.Find(nil)
+	c.Assert(err, IsNil)
+	count := 0
+	for {
+		file, err := iter.Next()
+		if err == mgo.NotFound {
+			break
+		}
+		c.Assert(err, IsNil)
+		file.Close()
+		count++
+	}
+	c.Assert(count, Equals, 3)
+}
+
+func (s *S) TestGridFSStat(c *C) {
+	session, err := mgo.Mongo("localhost:40011")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	db := session.DB("mydb")
+
+	gfs := db.GridFS("fs")
+
+	before := bson.Now()
+
+	file, err := gfs.Create("myfile.txt")
+	c.Assert(err, IsNil)
+	file.SetContentType("text/plain")
+	file.SetChunkSize(5)
+	file.SetInfo(M{"a": 1})
+	file.Write([]byte("some data"))
+	err = file.Close()
+	c.Assert(err, IsNil)
+
+	after := bson.Now()
+
+	file, err = gfs.Open("myfile.txt")
+	c.Assert(err, IsNil)
+	defer file.Close()
+
+	info := file.Stat()
+	c.Assert(info.Id, Equals, file.Id())
+	c.Assert(info.Name, Equals, "myfile.txt")
+	c.Assert(info.Length, Equals, int64(9))
+	c.Assert(info.ChunkSize, Equals, 5)
+	c.Assert(info.MD5, Equals, "1e50210a0202497fb79bc38b6ade6c34")
+	c.Assert(info.UploadDate >= int64(before) && info.UploadDate <= int64(after), Equals, true)
+	c.Assert(info.ContentType, Equals, "text/plain")
+
+	result := M{}
+	err = info.Metadata.Unmarshal(result)
+	c.Assert(err, IsNil)
+	c.Assert(result, Equals, M{"a": 1})
+}
+
+func (s *S) TestGridFSOpenRevision(c *C) {
+	session, err := mgo.Mongo("localhost:40011")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	db := session.DB("mydb")
+
+	gfs := db.GridFS("fs")
+
+	for _, data := range []string{"1", "2", "3"} {
+		file, err := gfs.Create("myfile.txt")
+		c.Assert(err, IsNil)
+		file.Write([]byte(data))
+		file.Close()
+	}
+
+	tests := []struct {
+		n    int
+		data string
+	}{{0, "1"}, {1, "2"}, {2, "3"}, {-1, "3"}, {-2, "2"}, {-3, "1"}}
+
+	var b [1]byte
+	for _, test := range tests {
+		file, err := gfs.OpenRevision("myfile.txt", test.n)
+		c.Assert(err, IsNil)
+		_, err = file.Read(b[:])
+		c.Assert(err, IsNil)
+		c.Assert(string(b[:]), Equals, test.data)
+		file.Close()
+	}
+
+	_, err = gfs.OpenRevision("myfile.txt", 3)
+	c.Assert(err == mgo.NotFound, Equals, true)
+	_, err = gfs.OpenRevision("myfile.txt", -4)
+	c.Assert(err == mgo.NotFound, Equals, true)
+}
+
+func (s *S) TestGridFSRevisions(c *C) {
+	session, err := mgo.Mongo("localhost:40011")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	db := session.DB("mydb")
+
+	gfs := db.GridFS("fs")
+
+	var ids []interface{}
+	for _, data := range []string{"1", "22", "333"} {
+		file, err := gfs.Create("myfile.txt")
+		c.Assert(err, IsNil)
+		file.Write([]byte(data))
+		file.Close()
+		ids = append(ids, file.Id())
+	}
+
+	revisions, err := gfs.Revisions("myfile.txt")
+	c.Assert(err, IsNil)
+	c.Assert(len(revisions), Equals, 3)
+	for i, info := range revisions {
+		c.Assert(info.Id, Equals, ids[i])
+		c.Assert(info.Length, Equals, int64(i+1))
+	}
+
+	revisions, err = gfs.Revisions("other.txt")
+	c.Assert(err, IsNil)
+	c.Assert(len(revisions), Equals, 0)
+}
+
+func (s *S) TestGridFSRemoveRevisions(c *C) {
+	session, err := mgo.Mongo("localhost:40011")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	db := session.DB("mydb")
+
+	gfs := db.GridFS("fs")
+
+	var ids []interface{}
+	for _, data := range []string{"1", "2", "3"} {
+		file, err := gfs.Create("myfile.txt")
+		c.Assert(err, IsNil)
+		file.Write([]byte(data))
+		file.Close()
+		ids = append(ids, file.Id())
+	}
+
+	err = gfs.RemoveRevisions("myfile.txt", 2)
+	c.Assert(err, IsNil)
+
+	revisions, err := gfs.Revisions("myfile.txt")
+	c.Assert(err, IsNil)
+	c.Assert(len(revisions), Equals, 2)
+	c.Assert(revisions[0].Id, Equals, ids[1])
+	c.Assert(revisions[1].Id, Equals, ids[2])
+
+	n, err := db.C("fs.chunks").Find(M{"files_id": ids[0]}).Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 0)
+
+	err = gfs.RemoveRevisions("myfile.txt", -1)
+	c.Assert(err, Matches, "RemoveRevisions: keep must not be negative")
+
+	err = gfs.RemoveRevisions("myfile.txt", 0)
+	c.Assert(err, IsNil)
+
+	n, err = db.C("fs.files").Find(nil).Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 0)
+}
+
+func (s *S) TestGridFSReadCorruptMD5(c *C) {
+	session, err := mgo.Mongo("localhost:40011")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	db := session.DB("mydb")
+
+	gfs := db.GridFS("fs")
+	file, err := gfs.Create("myfile.txt")
+	c.Assert(err, IsNil)
+	file.SetChunkSize(5)
+	file.Write([]byte("abcdefghij"))
+	err = file.Close()
+	c.Assert(err, IsNil)
+
+	err = db.C("fs.files").Update(M{"_id": file.Id()}, M{"$set": M{"md5": "00000000000000000000000000000000"}})
+	c.Assert(err, IsNil)
+
+	file, err = gfs.OpenId(file.Id())
+	c.Assert(err, IsNil)
+
+	b := make([]byte, 20)
+	n, err := file.Read(b)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 10)
+
+	n, err = file.Read(b)
+	c.Assert(n, Equals, 0)
+	c.Assert(err, Matches, "GridFS file \"myfile.txt\" .* is corrupted: content has MD5 a925576942e94b2ef57a066101b48876 rather than 0+")
+	_, ok := err.(*mgo.CorruptionError)
+	c.Assert(ok, Equals, true)
+
+	err = file.Close()
+	c.Assert(err, Matches, ".* is corrupted: content has MD5 .*")
+}
+
+func (s *S) TestGridFSReadMissingChunk(c *C) {
+	session, err := mgo.Mongo("localhost:40011")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	db := session.DB("mydb")
+
+	gfs := db.GridFS("fs")
+	file, err := gfs.Create("myfile.txt")
+	c.Assert(err, IsNil)
+	file.SetChunkSize(5)
+	file.Write([]byte("abcdefghijklmno"))
+	err = file.Close()
+	c.Assert(err, IsNil)
+
+	err = db.C("fs.chunks").Remove(M{"files_id": file.Id(), "n": 1})
+	c.Assert(err, IsNil)
+
+	file, err = gfs.OpenId(file.Id())
+	c.Assert(err, IsNil)
+
+	b := make([]byte, 20)
+	n, err := file.Read(b)
+	c.Assert(n, Equals, 5)
+	c.Assert(err, Matches, ".* is corrupted: chunk 1 is missing")
+
+	err = file.Close()
+	c.Assert(err, Matches, ".* is corrupted: chunk 1 is missing")
+}
+
+func (s *S) TestGridFSReadTruncatedChunk(c *C) {
+	session, err := mgo.Mongo("localhost:40011")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	db := session.DB("mydb")
+
+	gfs := db.GridFS("fs")
+	file, err := gfs.Create("myfile.txt")
+	c.Assert(err, IsNil)
+	file.SetChunkSize(5)
+	file.Write([]byte("abcdefghij"))
+	err = file.Close()
+	c.Assert(err, IsNil)
+
+	err = db.C("fs.chunks").Update(M{"files_id": file.Id(), "n": 0}, M{"$set": M{"data": []byte("abc")}})
+	c.Assert(err, IsNil)
+
+	file, err = gfs.OpenId(file.Id())
+	c.Assert(err, IsNil)
+	defer file.Close()
+
+	b := make([]byte, 20)
+	_, err = file.Read(b)
+	c.Assert(err, Matches, ".* is corrupted: chunk 0 has 3 bytes rather than 5")
+}
+
+func (s *S) TestGridFSReadAhead(c *C) {
+	session, err := mgo.Mongo("localhost:40011")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	db := session.DB("mydb")
+
+	gfs := db.GridFS("fs")
+
+	file, err := gfs.Create("")
+	c.Assert(err, IsNil)
+	file.SetChunkSize(5)
+	data := []byte("abcdefghijklmnopqrstuvwxyz0123456789ABCDEFGHIJKLMN")
+	file.Write(data)
+	err = file.Close()
+	c.Assert(err, IsNil)
+
+	// A negative window stands for the default read-ahead.
+	for _, window := range []int{-1, 0, 1, 2, 3, 20} {
+		file, err = gfs.OpenId(file.Id())
+		c.Assert(err, IsNil)
+		if window >= 0 {
+			file.SetReadAhead(window)
+		}
+
+		var result []byte
+		b := make([]byte, 7)
+		for {
+			n, err := file.Read(b)
+			if err == os.EOF {
+				break
+			}
+			c.Assert(err, IsNil)
+			result = append(result, b[:n]...)
+		}
+		c.Assert(result, Equals, data)
+		c.Assert(file.Close(), IsNil)
+	}
+}
+
+func (s *S) TestGridFSReadAheadSeek(c *C) {
+	session, err := mgo.Mongo("localhost:40011")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	db := session.DB("mydb")
+
+	gfs := db.GridFS("fs")
+
+	file, err := gfs.Create("")
+	c.Assert(err, IsNil)
+	file.SetChunkSize(5)
+	file.Write([]byte("abcdefghijklmnopqrstuvwxyz0123456789ABCDEFGHIJKLMN"))
+	err = file.Close()
+	c.Assert(err, IsNil)
+
+	file, err = gfs.OpenId(file.Id())
+	c.Assert(err, IsNil)
+	file.SetReadAhead(4)
+
+	b := make([]byte, 3)
+	_, err = file.Read(b)
+	c.Assert(err, IsNil)
+	c.Assert(b, Equals, []byte("abc"))
+
+	// Seeking outside of the window and back into it.
+	o, err := file.Seek(40, os.SEEK_SET)
+	c.Assert(err, IsNil)
+	c.Assert(o, Equals, int64(40))
+	_, err = file.Read(b)
+	c.Assert(err, IsNil)
+	c.Assert(b, Equals, []byte("EFG"))
+
+	o, err = file.Seek(12, os.SEEK_SET)
+	c.Assert(err, IsNil)
+	c.Assert(o, Equals, int64(12))
+	_, err = file.Read(b)
+	c.Assert(err, IsNil)
+	c.Assert(b, Equals, []byte("mno"))
+
+	// Closing with chunks still pending must not block.
+	c.Assert(file.Close(), IsNil)
+}
+
+func (s *S) TestGridFSReadAheadClosesCursor(c *C) {
+	session, err := mgo.Mongo("localhost:40011")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	db := session.DB("mydb")
+
+	gfs := db.GridFS("fs")
+
+	file, err := gfs.Create("")
+	c.Assert(err, IsNil)
+	file.SetChunkSize(1)
+	file.Write(make([]byte, 100))
+	err = file.Close()
+	c.Assert(err, IsNil)
+
+	openCursors := func() int {
+		var result struct {
+			Cursors struct {
+				TotalOpen int "totalOpen"
+			}
+		}
+		err := session.Run("serverStatus", &result)
+		c.Assert(err, IsNil)
+		return result.Cursors.TotalOpen
+	}
+	before := openCursors()
+
+	file, err = gfs.OpenId(file.Id())
+	c.Assert(err, IsNil)
+	file.SetReadAhead(2)
+	_, err = file.Read(make([]byte, 1))
+	c.Assert(err, IsNil)
+	c.Assert(file.Close(), IsNil)
+
+	// The read-ahead is cancelled in the background.
+	for i := 0; openCursors() != before; i++ {
+		if i == 50 {
+			c.Fatalf("Read-ahead cursor wasn't closed")
+		}
+		time.Sleep(1e8)
+	}
+}
+
+func (s *S) TestGridFSMaxPending(c *C) {
+	session, err := mgo.Mongo("localhost:40011")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	db := session.DB("mydb")
+
+	gfs := db.GridFS("fs")
+
+	file, err := gfs.Create("")
+	c.Assert(err, IsNil)
+	file.SetChunkSize(5)
+	file.SetMaxPending(1)
+	data := []byte("abcdefghijklmnopqrstuvwxyz")
+	for i := 0; i < len(data); i += 3 {
+		end := i + 3
+		if end > len(data) {
+			end = len(data)
+		}
+		_, err = file.Write(data[i:end])
+		c.Assert(err, IsNil)
+	}
+	err = file.Close()
+	c.Assert(err, IsNil)
+
+	file, err = gfs.OpenId(file.Id())
+	c.Assert(err, IsNil)
+	b := make([]byte, 30)
+	n, err := file.Read(b)
+	c.Assert(err, IsNil)
+	c.Assert(b[:n], Equals, data)
+	c.Assert(file.Close(), IsNil)
+}
+
+func (s *S) TestGridFSWriteFailureRemovesChunks(c *C) {
+	session, err := mgo.Mongo("localhost:40011")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	db := session.DB("mydb")
+
+	gfs := db.GridFS("fs")
+
+	index := mgo.Index{Key: []string{"files_id", "n"}, Unique: true}
+	err = db.C("fs.chunks").EnsureIndex(index)
+	c.Assert(err, IsNil)
+
+	// Chunk 1 is already taken, so inserting it must fail.
+	id := bson.NewObjectId()
+	err = db.C("fs.chunks").Insert(M{"files_id": id, "n": 1, "data": []byte("xxxxx")})
+	c.Assert(err, IsNil)
+
+	file, err := gfs.Create("myfile.txt")
+	c.Assert(err, IsNil)
+	file.SetId(id)
+	file.SetChunkSize(5)
+	file.Write([]byte("abcdefghijklmno"))
+	err = file.Close()
+	c.Assert(err, Matches, "GridFS chunk 1 insert failed: .*duplicate key.*")
+
+	werr, ok := err.(*mgo.GridWriteError)
+	c.Assert(ok, Equals, true)
+	c.Assert(werr.Chunks, Equals, []int{1})
+
+	// No chunks are left behind, and the file wasn't inserted.
+	n, err := db.C("fs.chunks").Find(M{"files_id": id}).Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 0)
+
+	_, err = gfs.OpenId(id)
+	c.Assert(err == mgo.NotFound, Equals, true)
+}
+
+func (s *S) TestGridFSReadAt(c *C) {
+	session, err := mgo.Mongo("localhost:40011")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	db := session.DB("mydb")
+
+	gfs := db.GridFS("fs")
+
+	file, err := gfs.Create("")
+	c.Assert(err, IsNil)
+	file.SetChunkSize(5)
+	data := []byte("abcdefghijklmnopqrstuv")
+	file.Write(data)
+	err = file.Close()
+	c.Assert(err, IsNil)
+
+	file, err = gfs.OpenId(file.Id())
+	c.Assert(err, IsNil)
+	defer file.Close()
+
+	// Move the sequential position, which ReadAt must not disturb.
+	b := make([]byte, 3)
+	_, err = file.Read(b)
+	c.Assert(err, IsNil)
+
+	tests := []struct {
+		off  int64
+		size int
+		data string
+		eof  bool
+	}{
+		{0, 3, "abc", false},
+		{3, 4, "defg", false},
+		{5, 5, "fghij", false},
+		{4, 12, "efghijklmnop", false},
+		{20, 5, "uv", true},
+		{22, 5, "", true},
+	}
+	for _, test := range tests {
+		b := make([]byte, test.size)
+		n, err := file.ReadAt(b, test.off)
+		if test.eof {
+			c.Assert(err == os.EOF, Equals, true)
+		} else {
+			c.Assert(err, IsNil)
+		}
+		c.Assert(string(b[:n]), Equals, test.data)
+	}
+
+	_, err = file.Read(b)
+	c.Assert(err, IsNil)
+	c.Assert(b, Equals, []byte("def"))
+
+	// Concurrent use is fine.
+	done := make(chan bool)
+	for i := 0; i != 10; i++ {
+		go func(off int64) {
+			b := make([]byte, 7)
+			n, err := file.ReadAt(b, off)
+			c.Check(err, IsNil)
+			c.Check(b[:n], Equals, data[off:off+7])
+			done <- true
+		}(int64(i))
+	}
+	for i := 0; i != 10; i++ {
+		<-done
+	}
+}
+
+func serveGridFS(h http.Handler, method, path string, header map[string]string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(method, "http://example.com"+path, nil)
+	if err != nil {
+		panic(err.String())
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func (s *S) TestGridFSHandler(c *C) {
+	session, err := mgo.Mongo("localhost:40011")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	db := session.DB("mydb")
+
+	gfs := db.GridFS("fs")
+
+	file, err := gfs.Create("dir/myfile.txt")
+	c.Assert(err, IsNil)
+	file.SetContentType("text/plain")
+	file.SetChunkSize(5)
+	file.Write([]byte("abcdefghijklmnopqrstuv"))
+	err = file.Close()
+	c.Assert(err, IsNil)
+
+	h := &mgo.GridHandler{GridFS: gfs, Prefix: "/files/"}
+
+	rec := serveGridFS(h, "GET", "/files/dir/myfile.txt", nil)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(rec.Body.String(), Equals, "abcdefghijklmnopqrstuv")
+	c.Assert(rec.HeaderMap.Get("Content-Type"), Equals, "text/plain")
+	c.Assert(rec.HeaderMap.Get("Content-Length"), Equals, "22")
+	c.Assert(rec.HeaderMap.Get("ETag"), Equals, `"`+file.MD5()+`"`)
+	lastModified := time.SecondsToUTC(file.UploadDate() / 1e9).Format(http.TimeFormat)
+	c.Assert(rec.HeaderMap.Get("Last-Modified"), Equals, lastModified)
+
+	rec = serveGridFS(h, "HEAD", "/files/dir/myfile.txt", nil)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(rec.Body.Len(), Equals, 0)
+	c.Assert(rec.HeaderMap.Get("Content-Length"), Equals, "22")
+
+	rec = serveGridFS(h, "GET", "/files/missing.txt", nil)
+	c.Assert(rec.Code, Equals, http.StatusNotFound)
+
+	rec = serveGridFS(h, "GET", "/other/dir/myfile.txt", nil)
+	c.Assert(rec.Code, Equals, http.StatusNotFound)
+
+	rec = serveGridFS(h, "POST", "/files/dir/myfile.txt", nil)
+	c.Assert(rec.Code, Equals, http.StatusMethodNotAllowed)
+}
+
+func (s *S) TestGridFSHandlerById(c *C) {
+	session, err := mgo.Mongo("localhost:40011")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	db := session.DB("mydb")
+
+	gfs := db.GridFS("fs")
+
+	file, err := gfs.Create("")
+	c.Assert(err, IsNil)
+	file.Write([]byte("some data"))
+	err = file.Close()
+	c.Assert(err, IsNil)
+
+	h := &mgo.GridHandler{GridFS: gfs, Prefix: "/", ById: true}
+
+	id := file.Id().(bson.ObjectId)
+	rec := serveGridFS(h, "GET", "/"+id.Hex(), nil)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(rec.Body.String(), Equals, "some data")
+	c.Assert(rec.HeaderMap.Get("Content-Type"), Equals, "application/octet-stream")
+
+	rec = serveGridFS(h, "GET", "/"+bson.NewObjectId().Hex(), nil)
+	c.Assert(rec.Code, Equals, http.StatusNotFound)
+
+	rec = serveGridFS(h, "GET", "/not-an-id", nil)
+	c.Assert(rec.Code, Equals, http.StatusNotFound)
+}
+
+func (s *S) TestGridFSHandlerConditional(c *C) {
+	session, err := mgo.Mongo("localhost:40011")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	db := session.DB("mydb")
+
+	gfs := db.GridFS("fs")
+
+	file, err := gfs.Create("myfile.txt")
+	c.Assert(err, IsNil)
+	file.Write([]byte("some data"))
+	err = file.Close()
+	c.Assert(err, IsNil)
+
+	h := &mgo.GridHandler{GridFS: gfs}
+	etag := `"` + file.MD5() + `"`
+
+	rec := serveGridFS(h, "GET", "/myfile.txt", map[string]string{"If-None-Match": etag})
+	c.Assert(rec.Code, Equals, http.StatusNotModified)
+	c.Assert(rec.Body.Len(), Equals, 0)
+
+	rec = serveGridFS(h, "GET", "/myfile.txt", map[string]string{"If-None-Match": `"other", ` + etag})
+	c.Assert(rec.Code, Equals, http.StatusNotModified)
+
+	rec = serveGridFS(h, "GET", "/myfile.txt", map[string]string{"If-None-Match": `"other"`})
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(rec.Body.String(), Equals, "some data")
+}
+
+func (s *S) TestGridFSHandlerRange(c *C) {
+	session, err := mgo.Mongo("localhost:40011")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	db := session.DB("mydb")
+
+	gfs := db.GridFS("fs")
+
+	file, err := gfs.Create("myfile.txt")
+	c.Assert(err, IsNil)
+	file.SetChunkSize(5)
+	file.Write([]byte("abcdefghijklmnopqrstuv"))
+	err = file.Close()
+	c.Assert(err, IsNil)
+
+	h := &mgo.GridHandler{GridFS: gfs, Prefix: "/"}
+
+	tests := []struct {
+		rng          string
+		code         int
+		contentRange string
+		body         string
+	}{
+		{"bytes=0-4", 206, "bytes 0-4/22", "abcde"},
+		{"bytes=3-12", 206, "bytes 3-12/22", "defghijklm"},
+		{"bytes=20-", 206, "bytes 20-21/22", "uv"},
+		{"bytes=-3", 206, "bytes 19-21/22", "tuv"},
+		{"bytes=10-100", 206, "bytes 10-21/22", "klmnopqrstuv"},
+		{"bytes=0-", 200, "", "abcdefghijklmnopqrstuv"},
+		{"bytes=0-1,3-4", 200, "", "abcdefghijklmnopqrstuv"},
+		{"bogus", 200, "", "abcdefghijklmnopqrstuv"},
+		{"bytes=22-", 416, "bytes */22", ""},
+	}
+	for _, test := range tests {
+		rec := serveGridFS(h, "GET", "/myfile.txt", map[string]string{"Range": test.rng})
+		c.Assert(rec.Code, Equals, test.code)
+		c.Assert(rec.HeaderMap.Get("Content-Range"), Equals, test.contentRange)
+		if test.code != 416 {
+			c.Assert(rec.Body.String(), Equals, test.body)
+			c.Assert(rec.HeaderMap.Get("Content-Length"), Equals, strconv.Itoa(len(test.body)))
+		}
+	}
+}
+
+func (s *S) TestGridFSHandlerCorrupt(c *C) {
+	session, err := mgo.Mongo("localhost:40011")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	db := session.DB("mydb")
+
+	gfs := db.GridFS("fs")
+
+	file, err := gfs.Create("myfile.txt")
+	c.Assert(err, IsNil)
+	file.SetChunkSize(5)
+	file.Write([]byte("abcdefghijklmnopqrstuv"))
+	err = file.Close()
+	c.Assert(err, IsNil)
+
+	err = db.C("fs.chunks").Remove(M{"files_id": file.Id(), "n": 0})
+	c.Assert(err, IsNil)
+
+	h := &mgo.GridHandler{GridFS: gfs, Prefix: "/"}
+
+	rec := serveGridFS(h, "GET", "/myfile.txt", nil)
+	c.Assert(rec.Code, Equals, http.StatusInternalServerError)
+	c.Assert(rec.HeaderMap.Get("ETag"), Equals, "")
+	c.Assert(rec.HeaderMap.Get("Last-Modified"), Equals, "")
+	c.Assert(rec.HeaderMap.Get("Content-Length"), Equals, "")
+
+	rec = serveGridFS(h, "GET", "/myfile.txt", map[string]string{"Range": "bytes=0-4"})
+	c.Assert(rec.Code, Equals, http.StatusInternalServerError)
+	c.Assert(rec.HeaderMap.Get("Content-Range"), Equals, "")
+
+	// Ranges only need their own chunks.
+	rec = serveGridFS(h, "GET", "/myfile.txt", map[string]string{"Range": "bytes=10-"})
+	c.Assert(rec.Code, Equals, http.StatusPartialContent)
+	c.Assert(rec.Body.String(), Equals, "klmnopqrstuv")
+}
+
+func (s *S) TestGridFSFsck(c *C) {
+	session, err := mgo.Mongo("localhost:40011")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	db := session.DB("mydb")
+
+	gfs := db.GridFS("fs")
+
+	create := func(name string) interface{} {
+		file, err := gfs.Create(name)
+		c.Assert(err, IsNil)
+		file.SetChunkSize(5)
+		file.Write([]byte("abcdefghijklmno"))
+		c.Assert(file.Close(), IsNil)
+		return file.Id()
+	}
+
+	create("good.txt")
+	missingId := create("missing.txt")
+	corruptId := create("corrupt.txt")
+
+	err = db.C("fs.chunks").Remove(M{"files_id": missingId, "n": 2})
+	c.Assert(err, IsNil)
+	err = db.C("fs.chunks").Update(M{"files_id": corruptId, "n": 1}, M{"$set": M{"data": []byte("XXXXX")}})
+	c.Assert(err, IsNil)
+
+	// Orphan chunks, as left by a writer which crashed.
+	oldId := bson.ObjectIdHex("4d88e15b60f486e428412dc9")
+	err = db.C("fs.chunks").Insert(M{"_id": oldId, "files_id": "old", "n": 0, "data": []byte("x")})
+	c.Assert(err, IsNil)
+	err = db.C("fs.chunks").Insert(M{"_id": bson.NewObjectId(), "files_id": "recent", "n": 0, "data": []byte("x")})
+	c.Assert(err, IsNil)
+
+	// The broken files were just written, so they might still be in
+	// progress, and only the old orphan is reported.
+	report, err := gfs.Fsck(3600e9, false)
+	c.Assert(err, IsNil)
+	c.Assert(report.Files, Equals, 3)
+	c.Assert(report.Chunks, Equals, 8)
+	c.Assert(report.Orphans, Equals, []interface{}{"old"})
+	c.Assert(report.OrphanChunks, Equals, 1)
+	c.Assert(len(report.Incomplete), Equals, 0)
+	c.Assert(len(report.Corrupt), Equals, 0)
+	c.Assert(report.Repaired, Equals, false)
+
+	// With no grace period, everything is reported.
+	report, err = gfs.Fsck(0, false)
+	c.Assert(err, IsNil)
+	c.Assert(report.Files, Equals, 3)
+	c.Assert(report.Chunks, Equals, 8)
+	c.Assert(report.Orphans, Equals, []interface{}{"old", "recent"})
+	c.Assert(report.OrphanChunks, Equals, 2)
+	c.Assert(report.Incomplete, Equals, []mgo.GridFsckProblem{{missingId, "missing.txt", "chunk 2 is missing"}})
+	c.Assert(len(report.Corrupt), Equals, 1)
+	c.Assert(report.Corrupt[0].Id, Equals, corruptId)
+	c.Assert(report.Corrupt[0].Reason, Matches, "content has MD5 .* rather than .*")
+	c.Assert(report.Repaired, Equals, false)
+
+	// Nothing was changed.
+	n, err := db.C("fs.chunks").Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 10)
+
+	report, err = gfs.Fsck(3600e9, true)
+	c.Assert(err, IsNil)
+	c.Assert(report.Repaired, Equals, true)
+	c.Assert(report.Orphans, Equals, []interface{}{"old"})
+
+	n, err = db.C("fs.chunks").Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 9)
+
+	report, err = gfs.Fsck(0, true)
+	c.Assert(err, IsNil)
+	c.Assert(report.Repaired, Equals, true)
+	c.Assert(report.Orphans, Equals, []interface{}{"recent"})
+	c.Assert(len(report.Incomplete), Equals, 1)
+	c.Assert(len(report.Corrupt), Equals, 1)
+
+	// The file with a bad MD5 has all of its data, so it's kept.
+	report, err = gfs.Fsck(0, false)
+	c.Assert(err, IsNil)
+	c.Assert(report.Files, Equals, 2)
+	c.Assert(report.Chunks, Equals, 6)
+	c.Assert(len(report.Orphans), Equals, 0)
+	c.Assert(len(report.Incomplete), Equals, 0)
+	c.Assert(len(report.Corrupt), Equals, 1)
+	c.Assert(report.Corrupt[0].Id, Equals, corruptId)
+
+	n, err = db.C("fs.chunks").Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 6)
+
+	file, err := gfs.OpenId(corruptId)
+	c.Assert(err, IsNil)
+	c.Assert(file.Size(), Equals, int64(15))
+	file.Close()
+}
+
+func (s *S) TestGridFSResumeId(c *C) {
+	session, err := mgo.Mongo("localhost:40011")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	db := session.DB("mydb")
+
+	gfs := db.GridFS("fs")
+
+	// Chunks left behind by an interrupted upload.
+	id := bson.NewObjectId()
+	for n, data := range []string{"abcde", "fghij", "kl"} {
+		err = db.C("fs.chunks").Insert(M{"_id": bson.NewObjectId(), "files_id": id, "n": n, "data": []byte(data)})
+		c.Assert(err, IsNil)
+	}
+
+	file, err := gfs.ResumeId(id)
+	c.Assert(err, IsNil)
+	c.Assert(file.Size(), Equals, int64(12))
+	file.SetName("myfile.txt")
+	_, err = file.Write([]byte("mnopq"))
+	c.Assert(err, IsNil)
+	err = file.Close()
+	c.Assert(err, IsNil)
+
+	file, err = gfs.Open("myfile.txt")
+	c.Assert(err, IsNil)
+	c.Assert(file.Id(), Equals, id)
+	c.Assert(file.Size(), Equals, int64(17))
+	c.Assert(file.MD5(), Equals, "9a8d9845a6b4d82dfcb2c2e35162c830")
+	b := make([]byte, 30)
+	n, err := file.Read(b)
+	c.Assert(err, IsNil)
+	c.Assert(string(b[:n]), Equals, "abcdefghijklmnopq")
+	c.Assert(file.Close(), IsNil)
+
+	n, err = db.C("fs.chunks").Find(M{"files_id": id}).Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 4)
+
+	// The file is complete now.
+	_, err = gfs.ResumeId(id)
+	c.Assert(err, Matches, "GridFS file was already closed; use AppendId to write to it")
+
+	_, err = gfs.ResumeId(bson.NewObjectId())
+	c.Assert(err == mgo.NotFound, Equals, true)
+}
+
+func (s *S) TestGridFSResumeIdMissingChunk(c *C) {
+	session, err := mgo.Mongo("localhost:40011")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	db := session.DB("mydb")
+
+	gfs := db.GridFS("fs")
+
+	// Chunk 1 was still pending when the upload was interrupted.
+	id := bson.NewObjectId()
+	for n, data := range []string{"abcde", "", "klmno", "pq"} {
+		if data == "" {
+			continue
+		}
+		err = db.C("fs.chunks").Insert(M{"_id": bson.NewObjectId(), "files_id": id, "n": n, "data": []byte(data)})
+		c.Assert(err, IsNil)
+	}
+
+	file, err := gfs.ResumeId(id)
+	c.Assert(err, IsNil)
+	c.Assert(file.Size(), Equals, int64(5))
+	file.SetChunkSize(5)
+
+	n, err := db.C("fs.chunks").Find(M{"files_id": id}).Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 1)
+
+	_, err = file.Write([]byte("fghijklmnopq"))
+	c.Assert(err, IsNil)
+	err = file.Close()
+	c.Assert(err, IsNil)
+
+	file, err = gfs.OpenId(id)
+	c.Assert(err, IsNil)
+	b := make([]byte, 30)
+	n, err = file.Read(b)
+	c.Assert(err, IsNil)
+	c.Assert(string(b[:n]), Equals, "abcdefghijklmnopq")
+	c.Assert(file.Close(), IsNil)
+}
+
+func (s *S) TestGridFSResumeIdMissingFirstChunk(c *C) {
+	session, err := mgo.Mongo("localhost:40011")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	db := session.DB("mydb")
+
+	gfs := db.GridFS("fs")
+
+	// Chunk 0 was still pending, so nothing can be recovered.
+	id := bson.NewObjectId()
+	for n, data := range []string{"fghij", "klmno"} {
+		err = db.C("fs.chunks").Insert(M{"_id": bson.NewObjectId(), "files_id": id, "n": n + 1, "data": []byte(data)})
+		c.Assert(err, IsNil)
+	}
+
+	_, err = gfs.ResumeId(id)
+	c.Assert(err, Matches, ".*chunk 0 is missing.*")
+	_, ok := err.(*mgo.CorruptionError)
+	c.Assert(ok, Equals, true)
+
+	// The chunks are left alone.
+	n, err := db.C("fs.chunks").Find(M{"files_id": id}).Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 2)
+}
+
+func (s *S) TestGridFSAppend(c *C) {
+	session, err := mgo.Mongo("localhost:40011")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	db := session.DB("mydb")
+
+	// Other drivers enforce a single chunk per position.
+	err = db.C("fs.chunks").EnsureIndex(mgo.Index{Key: []string{"files_id", "n"}, Unique: true})
+	c.Assert(err, IsNil)
+
+	gfs := db.GridFS("fs")
+
+	file, err := gfs.Create("myfile.txt")
+	c.Assert(err, IsNil)
+	file.SetChunkSize(5)
+	file.SetContentType("text/plain")
+	file.Write([]byte("abcdefg"))
+	err = file.Close()
+	c.Assert(err, IsNil)
+	id := file.Id()
+	uploadDate := file.UploadDate()
+
+	time.Sleep(2e6)
+
+	file, err = gfs.Append("myfile.txt")
+	c.Assert(err, IsNil)
+	c.Assert(file.Id(), Equals, id)
+	c.Assert(file.Size(), Equals, int64(7))
+	file.Write([]byte("hij"))
+	file.Write([]byte("klm"))
+	err = file.Close()
+	c.Assert(err, IsNil)
+
+	file, err = gfs.OpenId(id)
+	c.Assert(err, IsNil)
+	c.Assert(file.Size(), Equals, int64(13))
+	c.Assert(file.MD5(), Equals, "22aebdd14e72f6b379476a146347d546")
+	c.Assert(file.ContentType(), Equals, "text/plain")
+	c.Assert(file.UploadDate() > uploadDate, Equals, true)
+	b := make([]byte, 30)
+	n, err := file.Read(b)
+	c.Assert(err, IsNil)
+	c.Assert(string(b[:n]), Equals, "abcdefghijklm")
+	c.Assert(file.Close(), IsNil)
+
+	n, err = db.C("fs.chunks").Find(M{"files_id": id}).Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 3)
+
+	n, err = db.C("fs.files").Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 1)
+
+	_, err = gfs.AppendId(bson.NewObjectId())
+	c.Assert(err == mgo.NotFound, Equals, true)
+}
+
+func (s *S) TestGridFSCompression(c *C) {
+	session, err := mgo.Mongo("localhost:40011")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	db := session.DB("mydb")
+
+	gfs := db.GridFS("fs")
+
+	data := make([]byte, 1000)
+	for i := range data {
+		data[i] = "abcdefghij"[i%10]
+	}
+
+	for _, compression := range []string{"gzip", "flate"} {
+		file, err := gfs.Create("myfile.txt")
+		c.Assert(err, IsNil)
+		file.SetChunkSize(300)
+		file.SetCompression(compression)
+		file.Write(data)
+		err = file.Close()
+		c.Assert(err, IsNil)
+		id := file.Id()
+
+		result := M{}
+		err = db.C("fs.files").Find(M{"_id": id}).One(result)
+		c.Assert(err, IsNil)
+		c.Assert(result["compression"], Equals, compression)
+		c.Assert(result["length"], Equals, int64(1000))
+		c.Assert(result["md5"], Equals, "33ef314bbf752a16bcc48256b4b89e8e")
+
+		var chunk struct{ Data []byte }
+		err = db.C("fs.chunks").Find(M{"files_id": id, "n": 0}).One(&chunk)
+		c.Assert(err, IsNil)
+		c.Assert(len(chunk.Data) < 300, Equals, true)
+
+		file, err = gfs.OpenId(id)
+		c.Assert(err, IsNil)
+		c.Assert(file.Size(), Equals, int64(1000))
+		c.Assert(file.Stat().Compression, Equals, compression)
+		b := make([]byte, 2000)
+		n, err := io.ReadFull(file, b[:1000])
+		c.Assert(err, IsNil)
+		c.Assert(string(b[:n]), Equals, string(data))
+
+		o, err := file.Seek(615, os.SEEK_SET)
+		c.Assert(err, IsNil)
+		c.Assert(o, Equals, int64(615))
+		n, err = file.Read(b[:10])
+		c.Assert(err, IsNil)
+		c.Assert(string(b[:n]), Equals, "fghijabcde")
+
+		n, err = file.ReadAt(b[:20], 290)
+		c.Assert(err, IsNil)
+		c.Assert(string(b[:n]), Equals, "abcdefghijabcdefghij")
+		c.Assert(file.Close(), IsNil)
+	}
+}
+
+func (s *S) TestGridFSCompressionDefault(c *C) {
+	session, err := mgo.Mongo("localhost:40011")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	db := session.DB("mydb")
+
+	gfs := db.GridFS("fs")
+	gfs.Compression = "gzip"
+
+	file, err := gfs.Create("myfile.txt")
+	c.Assert(err, IsNil)
+	file.Write([]byte("some data"))
+	err = file.Close()
+	c.Assert(err, IsNil)
+
+	file, err = gfs.Open("myfile.txt")
+	c.Assert(err, IsNil)
+	c.Assert(file.Stat().Compression, Equals, "gzip")
+	b := make([]byte, 20)
+	n, err := file.Read(b)
+	c.Assert(err, IsNil)
+	c.Assert(string(b[:n]), Equals, "some data")
+	c.Assert(file.Close(), IsNil)
+}
+
+func (s *S) TestGridFSCompressionUnsupported(c *C) {
+	session, err := mgo.Mongo("localhost:40011")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	db := session.DB("mydb")
+
+	gfs := db.GridFS("fs")
+
+	file, err := gfs.Create("myfile.txt")
+	c.Assert(err, IsNil)
+	file.SetCompression("lzma")
+	file.Write([]byte("some data"))
+	err = file.Close()
+	c.Assert(err, Matches, "Unsupported GridFS compression: lzma")
+
+	n, err := db.C("fs.files").Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 0)
+}
@@ -0,0 +1,259 @@
+// mgo - MongoDB driver for Go
+// 
+// Copyright (c) 2010-2011 - Gustavo Niemeyer <gustavo@niemeyer.net>
+// 
+// All rights reserved.
+// 
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// 
+//     * Redistributions of source code must retain the above copyright notice,
+//       this list of conditions and the following disclaimer.
+//     * Redistributions in binary form must reproduce the above copyright notice,
+//       this list of conditions and the following disclaimer in the documentation
+//       and/or other materials provided with the distribution.
+//     * Neither the name of the copyright holder nor the names of its
+//       contributors may be used to endorse or promote products derived from
+//       this software without specific prior written permission.
+// 
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package mgo
+
+import (
+	"encoding/hex"
+	"fmt"
+	"github.com/CloudMarc/mgo/gobson"
+	"http"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GridHandler is an http.Handler serving files stored in a GridFS.
+//
+// The path of each request, with Prefix removed, identifies the file to
+// serve.  By default the path is the file name, and the most recent
+// revision of the file is served.  If ById is true, the path must instead
+// hold the hex representation of the file ObjectId.
+//
+// Responses have the Content-Type recorded for the file, or
+// application/octet-stream if none was set, the Content-Length, an ETag
+// made out of the file MD5, and a Last-Modified header with its upload
+// date.  Requests with an If-None-Match header matching the ETag get a
+// 304 Not Modified response, and requests with a Range header for a single
+// byte range get a 206 Partial Content response with just that range.
+//
+// For example:
+//
+//     gfs := session.DB("mydb").GridFS("fs")
+//     http.Handle("/files/", &mgo.GridHandler{GridFS: gfs, Prefix: "/files/"})
+//
+type GridHandler struct {
+	GridFS *GridFS
+	Prefix string
+	ById   bool
+}
+
+func (h *GridHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	path := r.URL.Path
+	if !strings.HasPrefix(path, h.Prefix) || len(path) == len(h.Prefix) {
+		http.NotFound(w, r)
+		return
+	}
+	path = path[len(h.Prefix):]
+
+	// Use a separate session per request so that concurrent
+	// requests don't wait on each other.
+	session := h.GridFS.Files.DB.Session.Copy()
+	defer session.Close()
+	gfs := *h.GridFS
+	gfs.Files.DB.Session = session
+	gfs.Chunks.DB.Session = session
+
+	var file *GridFile
+	var err os.Error
+	if h.ById {
+		id, herr := hex.DecodeString(path)
+		if herr != nil || len(id) != 12 {
+			http.NotFound(w, r)
+			return
+		}
+		file, err = gfs.OpenId(bson.ObjectId(id))
+	} else {
+		file, err = gfs.Open(path)
+	}
+	if err == NotFound {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		logf("GridHandler: failed to open %q: %s", path, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			logf("GridHandler: failed to close %q: %s", path, err)
+		}
+	}()
+
+	size := file.Size()
+	lastModified := time.SecondsToUTC(file.UploadDate() / 1e9).Format(http.TimeFormat)
+	etag := ""
+	if md5 := file.MD5(); md5 != "" {
+		etag = `"` + md5 + `"`
+	}
+
+	// The validators are only sent along with the content, or in place
+	// of it, so that error responses don't carry them.
+	header := w.Header()
+	setValidators := func() {
+		header.Set("Last-Modified", lastModified)
+		if etag != "" {
+			header.Set("ETag", etag)
+		}
+	}
+
+	if etag != "" && matchETag(r.Header.Get("If-None-Match"), etag) {
+		setValidators()
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	start, length := int64(0), size
+	status := http.StatusOK
+	contentRange := ""
+	if s := r.Header.Get("Range"); s != "" {
+		var ok bool
+		start, length, ok = parseRange(s, size)
+		if !ok {
+			header.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			http.Error(w, "Requested range not satisfiable", http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		if length != size {
+			status = http.StatusPartialContent
+			contentRange = fmt.Sprintf("bytes %d-%d/%d", start, start+length-1, size)
+		}
+	}
+	setHeaders := func() {
+		ctype := file.ContentType()
+		if ctype == "" {
+			ctype = "application/octet-stream"
+		}
+		header.Set("Content-Type", ctype)
+		header.Set("Accept-Ranges", "bytes")
+		setValidators()
+		if contentRange != "" {
+			header.Set("Content-Range", contentRange)
+		}
+		header.Set("Content-Length", strconv.Itoa64(length))
+	}
+	if r.Method == "HEAD" || length == 0 {
+		setHeaders()
+		w.WriteHeader(status)
+		return
+	}
+
+	// Read the range through ReadAt, which fetches just the chunks
+	// needed.  The beginning of the data is read before the status is
+	// sent, so that a file which can't be read gets an error response.
+	section := io.NewSectionReader(file, start, length)
+	buf := make([]byte, 32*1024)
+	if int64(len(buf)) > length {
+		buf = buf[:length]
+	}
+	n, err := io.ReadFull(section, buf)
+	if err != nil {
+		logf("GridHandler: failed to serve %q: %s", path, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	setHeaders()
+	w.WriteHeader(status)
+	_, err = w.Write(buf[:n])
+	if err == nil {
+		_, err = io.Copy(w, section)
+	}
+	if err != nil {
+		// The status was already sent, so just give up.
+		logf("GridHandler: failed to serve %q: %s", path, err)
+	}
+}
+
+// matchETag returns whether the If-None-Match header value s matches etag.
+func matchETag(s, etag string) bool {
+	for _, candidate := range strings.Split(s, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || candidate == etag || candidate == "W/"+etag {
+			return true
+		}
+	}
+	return false
+}
+
+// parseRange parses the value of a Range header for a file of the given
+// size, returning the start and length of the requested range.  Ranges
+// which aren't understood, such as multiple ranges, are handled as the
+// full file.  If the range can't be satisfied, ok is false.
+func parseRange(s string, size int64) (start, length int64, ok bool) {
+	if !strings.HasPrefix(s, "bytes=") || strings.Index(s, ",") >= 0 {
+		return 0, size, true
+	}
+	spec := strings.TrimSpace(s[len("bytes="):])
+	i := strings.Index(spec, "-")
+	if i < 0 {
+		return 0, size, true
+	}
+	first, last := spec[:i], spec[i+1:]
+	if first == "" {
+		// Suffix range with the last n bytes.
+		n, err := strconv.Atoi64(last)
+		if err != nil || n < 0 {
+			return 0, size, true
+		}
+		if n == 0 || size == 0 {
+			return 0, 0, false
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, n, true
+	}
+	start, err := strconv.Atoi64(first)
+	if err != nil || start < 0 {
+		return 0, size, true
+	}
+	end := size - 1
+	if last != "" {
+		end, err = strconv.Atoi64(last)
+		if err != nil || end < start {
+			return 0, size, true
+		}
+		if end > size-1 {
+			end = size - 1
+		}
+	}
+	if start >= size {
+		return 0, 0, false
+	}
+	return start, end - start + 1, true
+}
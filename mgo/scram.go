@@ -0,0 +1,276 @@
+// mgo - MongoDB driver for Go
+// 
+// Copyright (c) 2010-2011 - Gustavo Niemeyer <gustavo@niemeyer.net>
+// 
+// All rights reserved.
+// 
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// 
+//     * Redistributions of source code must retain the above copyright notice,
+//       this list of conditions and the following disclaimer.
+//     * Redistributions in binary form must reproduce the above copyright notice,
+//       this list of conditions and the following disclaimer in the documentation
+//       and/or other materials provided with the distribution.
+//     * Neither the name of the copyright holder nor the names of its
+//       contributors may be used to endorse or promote products derived from
+//       this software without specific prior written permission.
+// 
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package mgo
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// saslMechanism is implemented by the client side of authentication
+// mechanisms which run over the saslStart/saslContinue commands.
+//
+// Step is called first with a nil input to obtain the initial payload,
+// and then with each payload received from the server.  Once the client
+// is satisfied with the conversation, done must be true.
+type saslMechanism interface {
+	Step(in []byte) (out []byte, done bool, err os.Error)
+}
+
+// scramClient implements the client side of the SCRAM authentication
+// mechanism, as defined in RFC 5802 (SCRAM-SHA-1) and RFC 7677
+// (SCRAM-SHA-256).
+type scramClient struct {
+	newHash     func() hash.Hash
+	hashName    string
+	user        string
+	pass        string
+	clientNonce []byte
+	step        int
+	authMsg     bytes.Buffer
+	serverSig   []byte
+}
+
+func newScramClient(newHash func() hash.Hash, hashName, user, pass string) (*scramClient, os.Error) {
+	nonce := make([]byte, 24)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	client := &scramClient{
+		newHash:     newHash,
+		hashName:    hashName,
+		user:        user,
+		pass:        pass,
+		clientNonce: b64encode(nonce),
+	}
+	return client, nil
+}
+
+// newSaslMechanism returns the SASL client for the mechanism in auth.
+func newSaslMechanism(auth authInfo) (saslMechanism, os.Error) {
+	switch auth.mechanism {
+	case "SCRAM-SHA-1":
+		// MongoDB uses the MONGODB-CR password digest as the
+		// SCRAM-SHA-1 password, so that stored credentials are
+		// usable with both mechanisms.
+		return newScramClient(sha1.New, "sha1", auth.user, passwordDigest(auth.user, auth.pass))
+	case "SCRAM-SHA-256":
+		// Note that SASLprep is not performed on the password, which
+		// only makes a difference for non-ASCII passwords.
+		return newScramClient(sha256.New, "sha256", auth.user, auth.pass)
+	}
+	return nil, os.NewError("Unsupported SASL authentication mechanism: " + auth.mechanism)
+}
+
+func (c *scramClient) Step(in []byte) (out []byte, done bool, err os.Error) {
+	c.step++
+	switch c.step {
+	case 1:
+		return c.clientFirst(), false, nil
+	case 2:
+		out, err = c.clientFinal(in)
+		return out, false, err
+	case 3:
+		err = c.serverFinal(in)
+		return nil, err == nil, err
+	}
+	if len(in) > 0 {
+		return nil, false, os.NewError("SCRAM: unexpected data after the end of the conversation")
+	}
+	return nil, true, nil
+}
+
+func (c *scramClient) clientFirst() []byte {
+	user := strings.Replace(c.user, "=", "=3D", -1)
+	user = strings.Replace(user, ",", "=2C", -1)
+	c.authMsg.WriteString("n=")
+	c.authMsg.WriteString(user)
+	c.authMsg.WriteString(",r=")
+	c.authMsg.Write(c.clientNonce)
+	return append([]byte("n,,"), c.authMsg.Bytes()...)
+}
+
+func (c *scramClient) clientFinal(in []byte) (out []byte, err os.Error) {
+	var nonce, salt []byte
+	iter := 0
+	for _, field := range bytes.Split(in, []byte(",")) {
+		if len(field) < 3 || field[1] != '=' {
+			return nil, os.NewError(fmt.Sprintf("SCRAM: invalid server message: %q", in))
+		}
+		switch field[0] {
+		case 'r':
+			nonce = field[2:]
+		case 's':
+			salt, err = b64decode(field[2:])
+			if err != nil {
+				return nil, os.NewError("SCRAM: invalid salt: " + err.String())
+			}
+		case 'i':
+			iter, err = strconv.Atoi(string(field[2:]))
+			if err != nil {
+				return nil, os.NewError("SCRAM: invalid iteration count: " + err.String())
+			}
+		case 'm':
+			return nil, os.NewError("SCRAM: unsupported mandatory extension")
+		}
+	}
+	if !bytes.HasPrefix(nonce, c.clientNonce) || len(nonce) == len(c.clientNonce) {
+		return nil, os.NewError("SCRAM: server nonce doesn't extend the client nonce")
+	}
+	if len(salt) == 0 || iter < 1 {
+		return nil, os.NewError(fmt.Sprintf("SCRAM: invalid server message: %q", in))
+	}
+
+	final := append([]byte("c=biws,r="), nonce...)
+	c.authMsg.WriteString(",")
+	c.authMsg.Write(in)
+	c.authMsg.WriteString(",")
+	c.authMsg.Write(final)
+
+	salted := c.saltedPassword(salt, iter)
+	clientKey := c.hmac(salted, "Client Key")
+	h := c.newHash()
+	h.Write(clientKey)
+	storedKey := h.Sum()
+	clientSig := c.hmac(storedKey, c.authMsg.String())
+	for i := range clientKey {
+		clientKey[i] ^= clientSig[i]
+	}
+	serverKey := c.hmac(salted, "Server Key")
+	c.serverSig = c.hmac(serverKey, c.authMsg.String())
+
+	final = append(final, ",p="...)
+	return append(final, b64encode(clientKey)...), nil
+}
+
+func (c *scramClient) serverFinal(in []byte) os.Error {
+	if bytes.HasPrefix(in, []byte("e=")) {
+		return os.NewError("SCRAM: server error: " + string(in[2:]))
+	}
+	if !bytes.HasPrefix(in, []byte("v=")) {
+		return os.NewError(fmt.Sprintf("SCRAM: invalid server message: %q", in))
+	}
+	if !bytes.Equal(in[2:], b64encode(c.serverSig)) {
+		return os.NewError("SCRAM: server signature mismatch")
+	}
+	return nil
+}
+
+func (c *scramClient) hmac(key []byte, data string) []byte {
+	mac := hmac.New(c.newHash, key)
+	mac.Write([]byte(data))
+	return mac.Sum()
+}
+
+// The salted password is expensive to compute on purpose, so it's cached
+// for each credential.  The server only changes the salt and iteration
+// count when the password itself is changed.  The cache is keyed on a
+// digest of the credential, so that passwords aren't kept in memory, and
+// it's bounded in size, since credentials may be rotated.
+const scramCacheSize = 64
+
+var scramCache = struct {
+	sync.Mutex
+	m map[string][]byte
+}{m: make(map[string][]byte)}
+
+func (c *scramClient) cacheKey(salt []byte, iter int) string {
+	h := sha256.New()
+	for _, field := range []string{c.hashName, c.user, c.pass, string(salt), strconv.Itoa(iter)} {
+		h.Write([]byte(strconv.Itoa(len(field)) + ":" + field))
+	}
+	return string(h.Sum())
+}
+
+func (c *scramClient) saltedPassword(salt []byte, iter int) []byte {
+	key := c.cacheKey(salt, iter)
+	scramCache.Lock()
+	salted, found := scramCache.m[key]
+	scramCache.Unlock()
+	if found {
+		return salted
+	}
+
+	// Hi(str, salt, i) from RFC 5802, which is PBKDF2 with HMAC
+	// as the pseudorandom function and a single output block.
+	mac := hmac.New(c.newHash, []byte(c.pass))
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	ui := mac.Sum()
+	salted = make([]byte, len(ui))
+	copy(salted, ui)
+	for i := 1; i < iter; i++ {
+		mac.Reset()
+		mac.Write(ui)
+		ui = mac.Sum()
+		for j := range ui {
+			salted[j] ^= ui[j]
+		}
+	}
+
+	scramCache.Lock()
+	if len(scramCache.m) >= scramCacheSize {
+		// Evict an arbitrary entry.
+		for k := range scramCache.m {
+			scramCache.m[k] = nil, false
+			break
+		}
+	}
+	scramCache.m[key] = salted
+	scramCache.Unlock()
+	return salted
+}
+
+func b64encode(data []byte) []byte {
+	out := make([]byte, base64.StdEncoding.EncodedLen(len(data)))
+	base64.StdEncoding.Encode(out, data)
+	return out
+}
+
+func b64decode(data []byte) ([]byte, os.Error) {
+	out := make([]byte, base64.StdEncoding.DecodedLen(len(data)))
+	n, err := base64.StdEncoding.Decode(out, data)
+	if err != nil {
+		return nil, err
+	}
+	return out[:n], nil
+}
@@ -0,0 +1,127 @@
+// mgo - MongoDB driver for Go
+// 
+// Copyright (c) 2010-2011 - Gustavo Niemeyer <gustavo@niemeyer.net>
+// 
+// All rights reserved.
+// 
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// 
+//     * Redistributions of source code must retain the above copyright notice,
+//       this list of conditions and the following disclaimer.
+//     * Redistributions in binary form must reproduce the above copyright notice,
+//       this list of conditions and the following disclaimer in the documentation
+//       and/or other materials provided with the distribution.
+//     * Neither the name of the copyright holder nor the names of its
+//       contributors may be used to endorse or promote products derived from
+//       this software without specific prior written permission.
+// 
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package mgo
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"hash"
+	"launchpad.net/gocheck"
+	"strings"
+)
+
+type SS struct{}
+
+var _ = gocheck.Suite(&SS{})
+
+var scramTests = []struct {
+	newHash     func() hash.Hash
+	hashName    string
+	user, pass  string
+	clientNonce string
+	steps       []string
+}{{
+	// RFC 5802, section 5.
+	sha1.New, "sha1", "user", "pencil", "fyko+d2lbbFgONRv9qkxdawL",
+	[]string{
+		"",
+		"n,,n=user,r=fyko+d2lbbFgONRv9qkxdawL",
+		"r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,s=QSXCR+Q6sek8bf92,i=4096",
+		"c=biws,r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,p=v0X8v3Bz2T0CJGbJQyF0X+HI4Ts=",
+		"v=rmF9pqV8S7suAoZWja4dJRkFsKQ=",
+		"",
+	},
+}, {
+	// RFC 7677, section 3.
+	sha256.New, "sha256", "user", "pencil", "rOprNGfwEbeRWgbNEkqO",
+	[]string{
+		"",
+		"n,,n=user,r=rOprNGfwEbeRWgbNEkqO",
+		"r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096",
+		"c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=",
+		"v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=",
+		"",
+	},
+}}
+
+func (s *SS) TestScramVectors(c *gocheck.C) {
+	for _, test := range scramTests {
+		client, err := newScramClient(test.newHash, test.hashName, test.user, test.pass)
+		c.Assert(err, gocheck.IsNil)
+		client.clientNonce = []byte(test.clientNonce)
+		for i := 0; i+1 < len(test.steps); i += 2 {
+			out, done, err := client.Step([]byte(test.steps[i]))
+			c.Assert(err, gocheck.IsNil)
+			c.Assert(string(out), gocheck.Equals, test.steps[i+1])
+			c.Assert(done, gocheck.Equals, i+2 == len(test.steps))
+		}
+	}
+}
+
+func (s *SS) TestScramBadServerSignature(c *gocheck.C) {
+	test := scramTests[0]
+	client, err := newScramClient(test.newHash, test.hashName, test.user, test.pass)
+	c.Assert(err, gocheck.IsNil)
+	client.clientNonce = []byte(test.clientNonce)
+	_, _, err = client.Step(nil)
+	c.Assert(err, gocheck.IsNil)
+	_, _, err = client.Step([]byte(test.steps[2]))
+	c.Assert(err, gocheck.IsNil)
+	_, done, err := client.Step([]byte("v=AAAApqV8S7suAoZWja4dJRkFsKQ="))
+	c.Assert(done, gocheck.Equals, false)
+	c.Assert(err, gocheck.Matches, "SCRAM: .*")
+}
+
+func (s *SS) TestScramBadNonce(c *gocheck.C) {
+	test := scramTests[0]
+	client, err := newScramClient(test.newHash, test.hashName, test.user, test.pass)
+	c.Assert(err, gocheck.IsNil)
+	client.clientNonce = []byte(test.clientNonce)
+	_, _, err = client.Step(nil)
+	c.Assert(err, gocheck.IsNil)
+	_, _, err = client.Step([]byte("r=other,s=QSXCR+Q6sek8bf92,i=4096"))
+	c.Assert(err, gocheck.Matches, "SCRAM: .*")
+}
+
+func (s *SS) TestScramCache(c *gocheck.C) {
+	client, err := newScramClient(sha1.New, "sha1", "user", "secret-password")
+	c.Assert(err, gocheck.IsNil)
+	for i := 0; i < scramCacheSize*2; i++ {
+		salted := client.saltedPassword([]byte{byte(i)}, 1)
+		c.Assert(client.saltedPassword([]byte{byte(i)}, 1), gocheck.Equals, salted)
+	}
+	scramCache.Lock()
+	defer scramCache.Unlock()
+	c.Assert(len(scramCache.m) <= scramCacheSize, gocheck.Equals, true)
+	for key := range scramCache.m {
+		c.Assert(strings.Contains(key, "secret-password"), gocheck.Equals, false)
+	}
+}
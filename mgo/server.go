@@ -31,6 +31,7 @@
 package mgo
 
 import (
+	"crypto/tls"
 	"sync"
 	"sort"
 	"net"
@@ -45,13 +46,15 @@ type mongoServer struct {
 	Addr         string
 	ResolvedAddr string
 	tcpaddr      *net.TCPAddr
+	tlsConfig    *tls.Config
+	certSubject  string
 	sockets      []*mongoSocket
 	closed       bool
 	master       bool
 }
 
 
-func newServer(addr string) (server *mongoServer, err os.Error) {
+func newServer(addr string, tlsConfig *tls.Config) (server *mongoServer, err os.Error) {
 	tcpaddr, err := net.ResolveTCPAddr("tcp", addr)
 	if err != nil {
 		log("Failed to resolve ", addr, ": ", err.String())
@@ -62,7 +65,14 @@ func newServer(addr string) (server *mongoServer, err os.Error) {
 	if resolvedAddr != addr {
 		debug("Address ", addr, " resolved as ", resolvedAddr)
 	}
-	server = &mongoServer{Addr: addr, ResolvedAddr: resolvedAddr, tcpaddr: tcpaddr}
+	server = &mongoServer{Addr: addr, ResolvedAddr: resolvedAddr, tcpaddr: tcpaddr, tlsConfig: tlsConfig}
+	if tlsConfig != nil && len(tlsConfig.Certificates) > 0 {
+		server.certSubject, err = certificateSubject(tlsConfig.Certificates[0])
+		if err != nil {
+			log("Failed to parse the TLS client certificate: ", err.String())
+			return nil, err
+		}
+	}
 	return
 }
 
@@ -99,15 +109,27 @@ func (server *mongoServer) Connect() (*mongoSocket, os.Error) {
 	server.RLock()
 	addr := server.Addr
 	tcpaddr := server.tcpaddr
+	tlsConfig := server.tlsConfig
 	master := server.master
 	server.RUnlock()
 
 	log("Establishing new connection to ", addr, "...")
-	conn, err := net.DialTCP("tcp", nil, tcpaddr)
+	tcpconn, err := net.DialTCP("tcp", nil, tcpaddr)
 	if err != nil {
 		log("Connection to ", addr, " failed: ", err.String())
 		return nil, err
 	}
+	var conn net.Conn = tcpconn
+	if tlsConfig != nil {
+		tlsconn := tls.Client(tcpconn, tlsConfig)
+		err = tlsconn.Handshake()
+		if err != nil {
+			log("TLS handshake with ", addr, " failed: ", err.String())
+			tcpconn.Close()
+			return nil, err
+		}
+		conn = tlsconn
+	}
 	log("Connection to ", addr, " established.")
 
 	stats.conn(+1, master)
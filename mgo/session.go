@@ -31,8 +31,7 @@
 package mgo
 
 import (
-	"crypto/md5"
-	"encoding/hex"
+	"crypto/tls"
 	"fmt"
 	//"launchpad.net/gobson/bson"
 	"github.com/CloudMarc/mgo/gobson"
@@ -164,6 +163,19 @@ const defaultPrefetch = 0.25
 //         that to talk to a slave you'll need to relax the consistency
 //         requirements via the Monotonic or Eventual session methods.
 //
+//     authMechanism=<mechanism>
+//
+//         Selects the mechanism used to authenticate with the credentials
+//         provided in the URL.  Supported mechanisms are MONGODB-CR (the
+//         default), SCRAM-SHA-1 and SCRAM-SHA-256.  MONGODB-X509 requires
+//         a TLS client certificate, so it must be selected through the
+//         DialInfo of MongoWithInfo instead.
+//
+//     authSource=<db>
+//
+//         Authenticate against the given database rather than the one
+//         named after the slash at the end of the host names.
+//
 // Relevant documentation:
 //
 //     http://www.mongodb.org/display/DOCS/Connections
@@ -173,28 +185,116 @@ func Mongo(url string) (session *Session, err os.Error) {
 	if err != nil {
 		return nil, err
 	}
-	direct := false
+	info := &DialInfo{
+		Addrs:    servers,
+		Database: auth.db,
+		Username: auth.user,
+		Password: auth.pass,
+	}
 	for k, v := range options {
 		switch k {
+		case "authMechanism":
+			if v == "MONGODB-X509" {
+				err = os.NewError("MONGODB-X509 authentication requires a TLS client certificate; use MongoWithInfo")
+				return
+			}
+			info.Mechanism = v
+			continue
+		case "authSource":
+			info.Database = v
+			continue
 		case "connect":
 			if v == "direct" {
-				direct = true
-				break
+				info.Direct = true
+				continue
 			}
 			if v == "replicaSet" {
-				break
+				continue
 			}
-			fallthrough
-		default:
-			err = os.NewError("Unsupported connection URL option: " + k + "=" + v)
-			return
 		}
+		err = os.NewError("Unsupported connection URL option: " + k + "=" + v)
+		return
+	}
+	return MongoWithInfo(info)
+}
+
+// DialInfo holds the options for establishing a session with a MongoDB
+// cluster through the MongoWithInfo function.  It offers the same
+// settings supported by the connection URL of the Mongo function.
+type DialInfo struct {
+	// Addrs holds the addresses of the seed servers, in the
+	// "host[:port]" format.  The port defaults to 27017.
+	Addrs []string
+
+	// Direct disables the automatic discovery of other servers in
+	// the cluster, similar to the connect=direct URL option.
+	Direct bool
+
+	// Timeout is the sync timeout for the new session, in nanoseconds.
+	// See the SetSyncTimeout method of Session.
+	Timeout int64
+
+	// Database is the database to authenticate against, if Username
+	// is set.  It defaults to "admin".
+	Database string
+
+	// Username and Password hold the credentials used to authenticate
+	// every socket used by the session and by sessions obtained out of
+	// it through the New method.
+	Username string
+	Password string
+
+	// Mechanism selects the authentication mechanism to use with the
+	// credentials.  See the Credential type for details.  With the
+	// MONGODB-X509 mechanism, Username may be empty, in which case the
+	// subject of the TLS client certificate is used.
+	Mechanism string
+
+	// CredentialProvider, if not nil, is used to authenticate every
+	// socket instead of Username and Password.  See the LoginWithProvider
+	// method of Session.
+	CredentialProvider CredentialProvider
+
+	// TLSConfig, if not nil, causes every connection to be established
+	// over TLS with the given configuration.  The first certificate in
+	// it, if any, is presented to the server as the client certificate.
+	TLSConfig *tls.Config
+}
+
+// MongoWithInfo establishes a new session to the cluster identified by
+// the seed servers in info.  See the Mongo function for details.
+func MongoWithInfo(info *DialInfo) (session *Session, err os.Error) {
+	if len(info.Addrs) == 0 {
+		return nil, os.NewError("No seed servers provided")
+	}
+	servers := make([]string, len(info.Addrs))
+	// XXX This is untested. The test suite doesn't use the standard port.
+	for i, server := range info.Addrs {
+		p := strings.LastIndexAny(server, "]:")
+		if p == -1 || server[p] != ':' {
+			server += ":27017"
+		}
+		servers[i] = server
 	}
-	cluster := newCluster(servers, direct)
+	var auth *authInfo
+	if info.CredentialProvider != nil {
+		cred, err := info.CredentialProvider.Credential(false)
+		if err != nil {
+			return nil, os.NewError("Can't obtain credentials: " + err.String())
+		}
+		auth = &authInfo{db: cred.Source, mechanism: cred.Mechanism, provider: &providerRef{info.CredentialProvider}}
+	} else if info.Username != "" || info.Mechanism == "MONGODB-X509" {
+		auth = &authInfo{db: info.Database, user: info.Username, pass: info.Password, mechanism: info.Mechanism}
+	}
+	if auth != nil && auth.db == "" {
+		auth.db = defaultAuthSource(auth.mechanism)
+	}
+	cluster := newCluster(servers, info.Direct, info.TLSConfig)
 	session = newSession(Strong, cluster, nil)
-	if auth.user != "" {
-		session.urlauth = &auth
-		session.auth = []authInfo{auth}
+	session.syncTimeout = info.Timeout
+	if auth != nil {
+		session.urlauth = auth
+		session.auth = []authInfo{*auth}
 	}
 	cluster.Release()
 	return session, nil
@@ -242,13 +342,6 @@ func parseURL(url string) (servers []string, auth authInfo, options map[string]s
 		auth.db = "admin"
 	}
 	servers = strings.Split(url, ",")
-	// XXX This is untested. The test suite doesn't use the standard port.
-	for i, server := range servers {
-		p := strings.LastIndexAny(server, "]:")
-		if p == -1 || server[p] != ':' {
-			servers[i] = server + ":27017"
-		}
-	}
 	return
 }
 
@@ -371,18 +464,110 @@ func (database Database) Run(cmd interface{}, result interface{}) os.Error {
 // Logout is explicitly called for the same database, or the session is
 // closed.
 //
+// The MONGODB-CR mechanism is used.  See the Login method of Session for
+// authenticating with other mechanisms.
+//
 // Concurrent Login calls will work correctly.
 func (database Database) Login(user, pass string) (err os.Error) {
-	session := database.Session
-	dbname := database.Name
+	return database.Session.login(authInfo{db: database.Name, user: user, pass: pass})
+}
+
+// Credential holds the details for authenticating with MongoDB through
+// the Login method of Session.
+type Credential struct {
+	// Username and Password hold the user credentials.
+	Username string
+	Password string
+
+	// Source is the database used to establish the credentials and
+	// privileges of the user.  It defaults to "admin", or to "$external"
+	// with the MONGODB-X509 mechanism.
+	Source string
+
+	// Mechanism selects the authentication mechanism.  The supported
+	// mechanisms are "MONGODB-CR", the default, which is unavailable
+	// in MongoDB 4.0+, "SCRAM-SHA-1", available in MongoDB 3.0+,
+	// "SCRAM-SHA-256", available in MongoDB 4.0+, and "MONGODB-X509",
+	// which authenticates with the TLS client certificate provided in
+	// DialInfo.TLSConfig.  With MONGODB-X509 the Password is unused, and
+	// Username defaults to the subject of the certificate.
+	Mechanism string
+}
+
+// Login authenticates with MongoDB using the provided credential.  The
+// authentication is valid for the whole session and will stay valid until
+// Logout is explicitly called for the same database, or the session is
+// closed.
+//
+// For example:
+//
+//     cred := &mgo.Credential{
+//         Username: "myuser",
+//         Password: "mypass",
+//         Source: "mydb",
+//         Mechanism: "SCRAM-SHA-1",
+//     }
+//     err := session.Login(cred)
+//
+// Concurrent Login calls will work correctly.
+func (session *Session) Login(cred *Credential) os.Error {
+	source := cred.Source
+	if source == "" {
+		source = defaultAuthSource(cred.Mechanism)
+	}
+	return session.login(authInfo{db: source, user: cred.Username, pass: cred.Password, mechanism: cred.Mechanism})
+}
+
+// CredentialProvider is implemented by types able to deliver the
+// credentials used for authenticating with MongoDB, such as ones reading
+// them from a file or from a secret store.  See the LoginWithProvider
+// method of Session.
+//
+// Credential is called whenever a new socket must be authenticated.  If
+// refresh is true, the previously delivered credential was rejected by
+// the server, and the provider should obtain a fresh one rather than
+// relying on any cached value.
+type CredentialProvider interface {
+	Credential(refresh bool) (*Credential, os.Error)
+}
+
+// LoginWithProvider authenticates with MongoDB using the credentials
+// delivered by provider.  Unlike with the Login method, the credentials
+// aren't retained by the session.  Instead, provider is consulted again
+// whenever a new socket must be authenticated, so that rotated passwords
+// are picked up without tearing the session down.  If the server rejects
+// the credentials, provider is asked to refresh them and the login is
+// retried once.
+//
+// The Source of the credential first delivered defines the database
+// authenticated against for the lifetime of the session.
+func (session *Session) LoginWithProvider(provider CredentialProvider) os.Error {
+	cred, err := provider.Credential(false)
+	if err != nil {
+		return os.NewError("Can't obtain credentials: " + err.String())
+	}
+	source := cred.Source
+	if source == "" {
+		source = defaultAuthSource(cred.Mechanism)
+	}
+	return session.login(authInfo{db: source, provider: &providerRef{provider}})
+}
+
+func defaultAuthSource(mechanism string) string {
+	if mechanism == "MONGODB-X509" {
+		return "$external"
+	}
+	return "admin"
+}
 
+func (session *Session) login(auth authInfo) os.Error {
 	socket, err := session.acquireSocket(false)
 	if err != nil {
 		return err
 	}
 	defer socket.Release()
 
-	err = socket.Login(dbname, user, pass)
+	err = socket.Login(auth)
 	if err != nil {
 		return err
 	}
@@ -390,14 +575,13 @@ func (database Database) Login(user, pass string) (err os.Error) {
 	session.m.Lock()
 	defer session.m.Unlock()
 
-	for _, a := range session.auth {
-		if a.db == dbname {
-			a.user = user
-			a.pass = pass
+	for i, a := range session.auth {
+		if a.db == auth.db {
+			session.auth[i] = auth
 			return nil
 		}
 	}
-	session.auth = append(session.auth, authInfo{dbname, user, pass})
+	session.auth = append(session.auth, auth)
 	return nil
 }
 
@@ -432,30 +616,354 @@ func (session *Session) LogoutAll() {
 }
 
 // AddUser creates or updates the authentication credentials of user within
-// the database.
+// the database.  The user is granted the read role if readOnly is true,
+// and the readWrite role otherwise.  See UpsertUser for finer control.
 func (database Database) AddUser(user, pass string, readOnly bool) os.Error {
-	psum := md5.New()
-	psum.Write([]byte(user + ":mongo:" + pass))
-	digest := hex.EncodeToString(psum.Sum())
-	c := database.C("system.users")
-	_, err := c.Upsert(bson.M{"user": user}, bson.M{"$set": bson.M{"user": user, "pwd": digest, "readOnly": readOnly}})
-	return err
+	role := RoleReadWrite
+	if readOnly {
+		role = RoleRead
+	}
+	return database.UpsertUser(&User{Username: user, Password: pass, Roles: []Role{role}})
 }
 
 // RemoveUser removes the authentication credentials of user from the database.
+// An error is returned if the user doesn't exist.  With servers older than
+// 2.6 that's only detected in safe mode, and the error is mgo.NotFound.
 func (database Database) RemoveUser(user string) os.Error {
+	result := struct{}{} // We don't care, but errors must be checked.
+	err := database.Run(bson.D{{"dropUser", user}}, &result)
+	if isNoCmd(err) {
+		users := database.C("system.users")
+		lerr, err := database.Session.writeQuery(&deleteOp{users.FullName, bson.M{"user": user}, 1})
+		if err == nil && lerr != nil && lerr.N == 0 {
+			return NotFound
+		}
+		return err
+	}
+	return err
+}
+
+// Role is a built-in or user-defined MongoDB role which grants a set of
+// privileges to the users holding it.
+//
+// Relevant documentation:
+//
+//     http://docs.mongodb.org/manual/reference/built-in-roles/
+//
+type Role string
+
+const (
+	RoleRead         Role = "read"
+	RoleReadAny      Role = "readAnyDatabase"
+	RoleReadWrite    Role = "readWrite"
+	RoleReadWriteAny Role = "readWriteAnyDatabase"
+	RoleDBAdmin      Role = "dbAdmin"
+	RoleDBAdminAny   Role = "dbAdminAnyDatabase"
+	RoleUserAdmin    Role = "userAdmin"
+	RoleUserAdminAny Role = "userAdminAnyDatabase"
+	RoleClusterAdmin Role = "clusterAdmin"
+	RoleRoot         Role = "root"
+)
+
+// User represents a MongoDB user, as handled by the UpsertUser and Users
+// methods of Database.
+type User struct {
+	// Username is the name of the user, unique within its database.
+	Username string
+
+	// Password is the new password for the user.  When updating an
+	// existing user, the password is left unchanged if this is empty.
+	// Passwords are never reported back by the Users method.
+	Password string
+
+	// Roles holds the roles granted to the user on its own database.
+	Roles []Role
+
+	// OtherDBRoles holds the roles granted to the user on other
+	// databases, indexed by database name.  It's only valid for users
+	// defined in the admin database.
+	OtherDBRoles map[string][]Role
+
+	// CustomData holds arbitrary information about the user, which
+	// is stored but not interpreted by the server.
+	CustomData interface{}
+}
+
+// RoleRef identifies a role granted on a given database.
+type RoleRef struct {
+	Role Role   "role"
+	DB   string "db"
+}
+
+// UserRef identifies a user defined in a given database.
+type UserRef struct {
+	Username string "user"
+	Source   string "db"
+}
+
+type userInfoDoc struct {
+	User       string
+	Db         string
+	Roles      []RoleRef
+	CustomData interface{} "customData"
+}
+
+type userDoc struct {
+	User         string
+	Pwd          string            ",omitempty"
+	ReadOnly     bool              "readOnly,omitempty"
+	Roles        []Role            ",omitempty"
+	OtherDBRoles map[string][]Role "otherDBRoles,omitempty"
+	CustomData   interface{}       "customData,omitempty"
+}
+
+// UpsertUser creates or updates the given user within the database.
+//
+// The user is created if it doesn't yet exist.  Otherwise, its roles are
+// replaced by the ones in user, its custom data is replaced if
+// user.CustomData is not nil, and its password is changed if
+// user.Password is not empty.
+//
+// With servers which don't support the createUser and updateUser commands
+// (MongoDB < 2.6), the system.users collection is updated directly.  Users
+// holding just the read or readWrite role in the database, or no roles at
+// all, are then written in the format predating roles, with the readOnly
+// flag set for all but readWrite, so that older servers understand them.
+//
+// Relevant documentation:
+//
+//     http://docs.mongodb.org/manual/reference/command/createUser/
+//     http://docs.mongodb.org/manual/reference/command/updateUser/
+//
+func (database Database) UpsertUser(user *User) os.Error {
+	if user.Username == "" {
+		return os.NewError("UpsertUser: user has no Username")
+	}
+	if len(user.OtherDBRoles) > 0 && database.Name != "admin" {
+		return os.NewError("UpsertUser: only users in the admin database may have OtherDBRoles")
+	}
+	roles := database.roleRefs(user.Roles, user.OtherDBRoles)
+
+	cmd := bson.D{{"updateUser", user.Username}}
+	if user.Password != "" {
+		cmd = append(cmd, bson.DocElem{"pwd", user.Password})
+	}
+	cmd = append(cmd, bson.DocElem{"roles", roles})
+	if user.CustomData != nil {
+		cmd = append(cmd, bson.DocElem{"customData", user.CustomData})
+	}
+	result := struct{}{} // We don't care, but errors must be checked.
+	err := database.Run(cmd, &result)
+	if qerr, ok := err.(*QueryError); ok && qerr.Code == userNotFoundCode {
+		if user.Password == "" {
+			return os.NewError("UpsertUser: new user " + user.Username + " has no Password")
+		}
+		cmd[0] = bson.DocElem{"createUser", user.Username}
+		err = database.Run(cmd, &result)
+	}
+	if isNoCmd(err) {
+		return database.upsertUserLegacy(user)
+	}
+	return err
+}
+
+func (database Database) upsertUserLegacy(user *User) os.Error {
+	set := bson.M{"user": user.Username}
+	unset := bson.M{}
+	if user.Password != "" {
+		set["pwd"] = passwordDigest(user.Username, user.Password)
+	}
+
+	// The server rejects documents holding both roles and the readOnly
+	// flag, so roles are only written when readOnly can't express them.
+	classic := user.OtherDBRoles == nil && len(user.Roles) <= 1
+	if len(user.Roles) == 1 && user.Roles[0] != RoleRead && user.Roles[0] != RoleReadWrite {
+		classic = false
+	}
+	if classic {
+		set["readOnly"] = len(user.Roles) == 0 || user.Roles[0] != RoleReadWrite
+		unset["roles"] = 1
+		unset["otherDBRoles"] = 1
+	} else {
+		set["roles"] = user.Roles
+		unset["readOnly"] = 1
+		if user.OtherDBRoles != nil {
+			set["otherDBRoles"] = user.OtherDBRoles
+		} else {
+			unset["otherDBRoles"] = 1
+		}
+	}
+	if user.CustomData != nil {
+		set["customData"] = user.CustomData
+	}
+	update := bson.M{"$set": set, "$unset": unset}
 	c := database.C("system.users")
-	return c.Remove(bson.M{"user": user})
+	_, err := c.Upsert(bson.M{"user": user.Username}, update)
+	return err
+}
+
+// GrantRoles grants the given roles to the named user, in addition to the
+// roles already held.  Roles on databases other than this one may be
+// provided in otherDBRoles, indexed by database name.
+//
+// Relevant documentation:
+//
+//     http://docs.mongodb.org/manual/reference/command/grantRolesToUser/
+//
+func (database Database) GrantRoles(username string, roles []Role, otherDBRoles map[string][]Role) os.Error {
+	cmd := bson.D{
+		{"grantRolesToUser", username},
+		{"roles", database.roleRefs(roles, otherDBRoles)},
+	}
+	result := struct{}{} // We don't care, but errors must be checked.
+	return database.Run(cmd, &result)
+}
+
+// RevokeRoles revokes the given roles from the named user.  Roles on
+// databases other than this one may be provided in otherDBRoles, indexed
+// by database name.
+//
+// Relevant documentation:
+//
+//     http://docs.mongodb.org/manual/reference/command/revokeRolesFromUser/
+//
+func (database Database) RevokeRoles(username string, roles []Role, otherDBRoles map[string][]Role) os.Error {
+	cmd := bson.D{
+		{"revokeRolesFromUser", username},
+		{"roles", database.roleRefs(roles, otherDBRoles)},
+	}
+	result := struct{}{} // We don't care, but errors must be checked.
+	return database.Run(cmd, &result)
+}
+
+func (database Database) roleRefs(roles []Role, otherDBRoles map[string][]Role) []RoleRef {
+	refs := make([]RoleRef, 0, len(roles))
+	for _, role := range roles {
+		refs = append(refs, RoleRef{role, database.Name})
+	}
+	dbs := make([]string, 0, len(otherDBRoles))
+	for db := range otherDBRoles {
+		dbs = append(dbs, db)
+	}
+	sort.StringSlice(dbs).Sort()
+	for _, db := range dbs {
+		for _, role := range otherDBRoles[db] {
+			refs = append(refs, RoleRef{role, db})
+		}
+	}
+	return refs
+}
+
+// Users returns all users defined in the database.  The Password field of
+// the returned users is always empty.
+//
+// Relevant documentation:
+//
+//     http://docs.mongodb.org/manual/reference/command/usersInfo/
+//
+func (database Database) Users() (users []User, err os.Error) {
+	var result struct {
+		Users []userInfoDoc
+	}
+	err = database.Run(bson.D{{"usersInfo", 1}}, &result)
+	if isNoCmd(err) {
+		return database.usersLegacy()
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range result.Users {
+		user := User{Username: info.User, CustomData: info.CustomData}
+		for _, ref := range info.Roles {
+			if ref.DB == info.Db {
+				user.Roles = append(user.Roles, ref.Role)
+				continue
+			}
+			if user.OtherDBRoles == nil {
+				user.OtherDBRoles = make(map[string][]Role)
+			}
+			user.OtherDBRoles[ref.DB] = append(user.OtherDBRoles[ref.DB], ref.Role)
+		}
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+func (database Database) usersLegacy() (users []User, err os.Error) {
+	var doc *userDoc
+	err = database.C("system.users").Find(nil).Sort(bson.M{"user": 1}).For(&doc, func() os.Error {
+		user := User{Username: doc.User, Roles: doc.Roles, OtherDBRoles: doc.OtherDBRoles, CustomData: doc.CustomData}
+		if user.Roles == nil {
+			// Users created by AddUser predate roles.
+			if doc.ReadOnly {
+				user.Roles = []Role{RoleRead}
+			} else {
+				user.Roles = []Role{RoleReadWrite}
+			}
+		}
+		users = append(users, user)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// ConnectionStatus holds the users authenticated on a connection and the
+// roles they hold, as reported by the ConnectionStatus method of Session.
+type ConnectionStatus struct {
+	Users []UserRef "authenticatedUsers"
+	Roles []RoleRef "authenticatedUserRoles"
+}
+
+// ConnectionStatus returns the users authenticated on the connection used
+// by the session, and the roles they hold.
+//
+// Relevant documentation:
+//
+//     http://docs.mongodb.org/manual/reference/command/connectionStatus/
+//
+func (session *Session) ConnectionStatus() (*ConnectionStatus, os.Error) {
+	var result struct {
+		AuthInfo ConnectionStatus "authInfo"
+	}
+	err := session.Run("connectionStatus", &result)
+	if err != nil {
+		return nil, err
+	}
+	return &result.AuthInfo, nil
+}
+
+const (
+	userNotFoundCode    = 11
+	commandNotFoundCode = 59
+)
+
+// isNoCmd returns whether err reports that the server doesn't know the
+// command run, which is the case with older servers.
+func isNoCmd(err os.Error) bool {
+	qerr, ok := err.(*QueryError)
+	if !ok {
+		return false
+	}
+	return qerr.Code == commandNotFoundCode || strings.HasPrefix(qerr.Message, "no such cmd")
 }
 
 type indexSpec struct {
-	Name, NS       string
-	Key            bson.D
-	Unique         bool ",omitempty"
-	DropDups       bool "dropDups,omitempty"
-	Background     bool ",omitempty"
-	Sparse         bool ",omitempty"
-	Bits, Min, Max int  ",omitempty"
+	Name, NS         string
+	Key              bson.D
+	Unique           bool        ",omitempty"
+	DropDups         bool        "dropDups,omitempty"
+	Background       bool        ",omitempty"
+	Sparse           bool        ",omitempty"
+	Bits, Min, Max   int         ",omitempty"
+	ExpireAfter      int         "expireAfterSeconds,omitempty"
+	PartialFilter    bson.M      "partialFilterExpression,omitempty"
+	Collation        *Collation  ",omitempty"
+	DefaultLanguage  string      "default_language,omitempty"
+	LanguageOverride string      "language_override,omitempty"
+	Weights          bson.D      ",omitempty"
 }
 
 type Index struct {
@@ -465,9 +973,36 @@ type Index struct {
 	Background bool     // Build index in background and return immediately
 	Sparse     bool     // Only index documents containing the Key fields
 
-	Name string // Index name, computed by EnsureIndex
+	Name string // Index name; computed by EnsureIndex from Key if unset
+
+	ExpireAfter   int64      // Remove documents once the indexed date is older than this, in nanoseconds
+	PartialFilter bson.M     // Only index documents matching this filter
+	Collation     *Collation // Locale-aware rules for comparing strings
 
 	Bits, Min, Max int // Properties for spatial indexes
+
+	DefaultLanguage  string         // Default language for text indexes
+	LanguageOverride string         // Document field holding the language of the document, for text indexes
+	Weights          map[string]int // Relative weight of text index fields; 1 by default
+}
+
+// The Collation type defines locale-aware rules for comparing strings,
+// as supported by MongoDB 3.4+.  Only Locale is mandatory.
+//
+// Relevant documentation:
+//
+//     https://docs.mongodb.com/manual/reference/collation/
+//
+type Collation struct {
+	Locale          string "locale"                    // ICU locale, such as "en" or "fr_CA"
+	CaseLevel       bool   "caseLevel,omitempty"       // Consider case differences at strength 1 or 2
+	CaseFirst       string "caseFirst,omitempty"       // Sort "upper" or "lower" case first
+	Strength        int    "strength,omitempty"        // Comparison level, from 1 to 5
+	NumericOrdering bool   "numericOrdering,omitempty" // Compare numeric strings as numbers
+	Alternate       string "alternate,omitempty"       // Set to "shifted" to ignore whitespace and punctuation
+	MaxVariable     string "maxVariable,omitempty"     // Which characters are ignored when Alternate is "shifted"
+	Normalization   bool   "normalization,omitempty"   // Check if text requires normalization
+	Backwards       bool   "backwards,omitempty"       // Sort secondary differences in reverse order
 }
 
 func parseIndexKey(key []string) (name string, realKey bson.D, err os.Error) {
@@ -478,6 +1013,20 @@ func parseIndexKey(key []string) (name string, realKey bson.D, err os.Error) {
 		}
 		if field != "" {
 			switch field[0] {
+			case '$':
+				c := strings.Index(field, ":")
+				if c < 0 {
+					return "", nil, os.NewError("Invalid index key: " + field)
+				}
+				kind := field[1:c]
+				switch kind {
+				case "text", "2dsphere", "hashed":
+				default:
+					return "", nil, os.NewError("Invalid index key kind: " + kind)
+				}
+				order = kind
+				field = field[c+1:]
+				name += field + "_" + kind
 			case '@':
 				order = "2d"
 				field = field[1:]
@@ -574,6 +1123,35 @@ func (collection Collection) EnsureIndexKey(key []string) os.Error {
 // provided, 26 bits are used, which is roughly equivalent to 1 foot of
 // precision for the default (-180, 180) index bounds.
 //
+// Other kinds of indexes are requested by prefixing the field name with
+// the kind name between a dollar sign and a colon.  The supported kinds
+// are "$text:" for full text search indexes, "$2dsphere:" for spherical
+// geometry indexes, and "$hashed:" for hashed indexes.  For example:
+//
+//     index := Index{
+//         Key: []string{"$text:title", "$text:body"},
+//         Weights: map[string]int{"title": 10},
+//         DefaultLanguage: "portuguese",
+//     }
+//     err := collection.EnsureIndex(index)
+//
+// With text indexes, Weights defines the relative importance of each
+// field when computing the score of a match, and DefaultLanguage and
+// LanguageOverride select the language used for stemming and stop words.
+//
+// If ExpireAfter is greater than zero, the index must be on a single
+// date field, and MongoDB will automatically remove documents once the
+// indexed date is older than ExpireAfter.  The removal runs in background
+// about once a minute, and the precision is of seconds.
+//
+// If PartialFilter is set, only documents matching the filter document
+// are included in the index (MongoDB 3.2+).  Collation changes the rules
+// used to compare strings within the index (MongoDB 3.4+).
+//
+// The index name is computed out of the Key by default.  A different
+// name may be provided via the Name field, in which case the index must
+// be dropped with DropIndexName rather than DropIndex.
+//
 // Relevant documentation:
 //
 //     http://www.mongodb.org/display/DOCS/Indexes
@@ -581,12 +1159,19 @@ func (collection Collection) EnsureIndexKey(key []string) os.Error {
 //     http://www.mongodb.org/display/DOCS/Indexing+as+a+Background+Operation
 //     http://www.mongodb.org/display/DOCS/Geospatial+Indexing
 //     http://www.mongodb.org/display/DOCS/Multikeys
+//     http://docs.mongodb.org/manual/core/index-ttl
+//     http://docs.mongodb.org/manual/core/index-text
+//     http://docs.mongodb.org/manual/core/2dsphere
+//     http://docs.mongodb.org/manual/core/index-partial
 //
 func (collection Collection) EnsureIndex(index Index) os.Error {
 	name, realKey, err := parseIndexKey(index.Key)
 	if err != nil {
 		return err
 	}
+	if index.Name != "" {
+		name = index.Name
+	}
 
 	db := collection.DB
 	session := db.Session
@@ -596,16 +1181,49 @@ func (collection Collection) EnsureIndex(index Index) os.Error {
 	}
 
 	spec := indexSpec{
-		Name:       name,
-		NS:         collection.FullName,
-		Key:        realKey,
-		Unique:     index.Unique,
-		DropDups:   index.DropDups,
-		Background: index.Background,
-		Sparse:     index.Sparse,
-		Bits:       index.Bits,
-		Min:        index.Min,
-		Max:        index.Max,
+		Name:             name,
+		NS:               collection.FullName,
+		Key:              realKey,
+		Unique:           index.Unique,
+		DropDups:         index.DropDups,
+		Background:       index.Background,
+		Sparse:           index.Sparse,
+		Bits:             index.Bits,
+		Min:              index.Min,
+		Max:              index.Max,
+		PartialFilter:    index.PartialFilter,
+		Collation:        index.Collation,
+		DefaultLanguage:  index.DefaultLanguage,
+		LanguageOverride: index.LanguageOverride,
+	}
+
+	if index.ExpireAfter > 0 {
+		spec.ExpireAfter = int(index.ExpireAfter / 1e9)
+		if spec.ExpireAfter < 1 {
+			spec.ExpireAfter = 1
+		}
+	}
+
+	if len(index.Weights) > 0 {
+		// Weights are sent in the order of the text fields in the key,
+		// followed by any others, such as the "$**" wildcard.
+		var fields, others []string
+		inKey := make(map[string]bool)
+		for _, elem := range realKey {
+			if _, ok := index.Weights[elem.Name]; ok && elem.Value == "text" {
+				fields = append(fields, elem.Name)
+				inKey[elem.Name] = true
+			}
+		}
+		for field := range index.Weights {
+			if !inKey[field] {
+				others = append(others, field)
+			}
+		}
+		sort.StringSlice(others).Sort()
+		for _, field := range append(fields, others...) {
+			spec.Weights = append(spec.Weights, bson.DocElem{field, index.Weights[field]})
+		}
 	}
 
 	session = session.Clone()
@@ -637,7 +1255,19 @@ func (collection Collection) DropIndex(key []string) os.Error {
 	if err != nil {
 		return err
 	}
+	return collection.DropIndexName(name)
+}
 
+// DropIndexName removes the index with the provided name from the
+// collection.  This is necessary to drop indexes which were created
+// with an explicit name (see the Name field of Index).
+//
+// For example:
+//
+//     err := collection.DropIndexName("my_index")
+//
+// See the EnsureIndex method for more details on indexes.
+func (collection Collection) DropIndexName(name string) os.Error {
 	db := collection.DB
 	session := db.Session
 	cacheKey := collection.FullName + "\x00" + name
@@ -653,7 +1283,7 @@ func (collection Collection) DropIndex(key []string) os.Error {
 		ErrMsg string
 		Ok     bool
 	}{}
-	err = db.Run(bson.D{{"dropIndexes", collection.Name}, {"index", name}}, &result)
+	err := db.Run(bson.D{{"dropIndexes", collection.Name}, {"index", name}}, &result)
 	if err != nil {
 		return err
 	}
@@ -663,7 +1293,9 @@ func (collection Collection) DropIndex(key []string) os.Error {
 	return nil
 }
 
-// Indexes returns a list of all indexes for the collection.
+// Indexes returns a list of all indexes for the collection.  For text
+// indexes, Weights holds the weight of every text field, including the
+// ones left with the default weight of 1.
 //
 // For example, this snippet would drop all available indexes:
 //
@@ -672,7 +1304,7 @@ func (collection Collection) DropIndex(key []string) os.Error {
 //       panic(err)
 //   }
 //   for _, index := range indexes {
-//       err = collection.DropIndex(index.Key)
+//       err = collection.DropIndexName(index.Name)
 //       if err != nil {
 //           panic(err)
 //       }
@@ -689,12 +1321,35 @@ func (collection Collection) Indexes() (indexes []Index, err os.Error) {
 			break
 		}
 		index := Index{
-			Name:       spec.Name,
-			Key:        simpleIndexKey(spec.Key),
-			Unique:     spec.Unique,
-			DropDups:   spec.DropDups,
-			Background: spec.Background,
-			Sparse:     spec.Sparse,
+			Name:             spec.Name,
+			Key:              simpleIndexKey(spec.Key, spec.Weights),
+			Unique:           spec.Unique,
+			DropDups:         spec.DropDups,
+			Background:       spec.Background,
+			Sparse:           spec.Sparse,
+			Bits:             spec.Bits,
+			Min:              spec.Min,
+			Max:              spec.Max,
+			ExpireAfter:      int64(spec.ExpireAfter) * 1e9,
+			PartialFilter:    spec.PartialFilter,
+			Collation:        spec.Collation,
+			DefaultLanguage:  spec.DefaultLanguage,
+			LanguageOverride: spec.LanguageOverride,
+		}
+		for _, w := range spec.Weights {
+			var weight int
+			switch v := w.Value.(type) {
+			case int:
+				weight = v
+			case int64:
+				weight = int(v)
+			case float64:
+				weight = int(v)
+			}
+			if index.Weights == nil {
+				index.Weights = make(map[string]int)
+			}
+			index.Weights[w.Name] = weight
 		}
 		indexes = append(indexes, index)
 	}
@@ -704,22 +1359,48 @@ func (collection Collection) Indexes() (indexes []Index, err os.Error) {
 	return
 }
 
-func simpleIndexKey(realKey bson.D) (key []string) {
+func simpleIndexKey(realKey bson.D, weights bson.D) (key []string) {
 	for i := range realKey {
 		field := realKey[i].Name
-		i, _ := realKey[i].Value.(int)
-		if i == 1 {
+		if field == "_ftsx" {
+			continue // Internal to text indexes.
+		}
+		var order float64
+		switch v := realKey[i].Value.(type) {
+		case int:
+			order = float64(v)
+		case int64:
+			order = float64(v)
+		case float64:
+			order = v
+		}
+		if order > 0 {
 			key = append(key, field)
 			continue
 		}
-		if i == -1 {
+		if order < 0 {
 			key = append(key, "-"+field)
 			continue
 		}
 		s, _ := realKey[i].Value.(string)
-		if s == "2d" {
+		switch s {
+		case "2d":
 			key = append(key, "@"+field)
 			continue
+		case "text":
+			if field == "_fts" {
+				// The text fields are only found in the weights, but
+				// their place among other fields is defined by the key.
+				for _, w := range weights {
+					key = append(key, "$text:"+w.Name)
+				}
+			} else {
+				key = append(key, "$text:"+field)
+			}
+			continue
+		case "2dsphere", "hashed":
+			key = append(key, "$"+s+":"+field)
+			continue
 		}
 		panic("Got unknown index key type for field " + field)
 	}
@@ -1175,6 +1856,21 @@ func (err *QueryError) String() string {
 	return err.Message
 }
 
+// The error code used by MongoDB when an operation is interrupted for
+// exceeding the limit defined via Query.SetMaxTime.
+const maxTimeErrorCode = 50
+
+// MaxTimeError is returned when the server aborts an operation for
+// exceeding the time limit set via the SetMaxTime method of Query.
+type MaxTimeError struct {
+	Code    int
+	Message string
+}
+
+func (err *MaxTimeError) String() string {
+	return err.Message
+}
+
 // Insert inserts one or more documents in the respective collection.  In
 // case the session is in safe mode (see the SetSafe method) and an error
 // happens while inserting the provided documents, the returned error will
@@ -1302,6 +1998,257 @@ func (collection Collection) DropCollection() os.Error {
 	return collection.DB.Run(bson.D{{"drop", collection.Name}}, nil)
 }
 
+// The CollectionInfo type holds the options used when explicitly creating
+// a collection with the Create method of Collection.
+type CollectionInfo struct {
+	// DisableIdIndex prevents the automatic creation of the index
+	// on the _id field for the collection.
+	DisableIdIndex bool
+
+	// Capped collections have a fixed size and the oldest documents
+	// are automatically removed to make room for new ones.  They also
+	// preserve the insertion order and may be used with tailable
+	// cursors (see the Tail method of Query).  MaxBytes must be
+	// provided together with Capped.
+	Capped bool
+
+	// MaxBytes is the maximum size of a capped collection, in bytes.
+	MaxBytes int
+
+	// MaxDocs is the maximum number of documents in a capped
+	// collection, if set.  MaxBytes is still enforced when MaxDocs
+	// is in use.
+	MaxDocs int
+
+	// Validator contains a query document which every inserted or
+	// updated document must match (MongoDB 3.2+).
+	Validator interface{}
+}
+
+// Create explicitly creates the collection with details of info.
+// MongoDB creates collections automatically on use, so this method
+// is only necessary when creating collections with non-default
+// characteristics, such as capped collections.
+//
+// For example, a capped collection suitable for use with tailable
+// cursors may be created as:
+//
+//     info := &mgo.CollectionInfo{Capped: true, MaxBytes: 1024 * 1024}
+//     err := collection.Create(info)
+//
+// Relevant documentation:
+//
+//     http://www.mongodb.org/display/DOCS/createCollection+Command
+//     http://www.mongodb.org/display/DOCS/Capped+Collections
+//
+func (collection Collection) Create(info *CollectionInfo) os.Error {
+	cmd := make(bson.D, 0, 6)
+	cmd = append(cmd, bson.DocElem{"create", collection.Name})
+	if info.Capped {
+		if info.MaxBytes < 1 {
+			return os.NewError("Collection.Create: with Capped, MaxBytes must also be set")
+		}
+		cmd = append(cmd, bson.DocElem{"capped", true})
+		cmd = append(cmd, bson.DocElem{"size", info.MaxBytes})
+		if info.MaxDocs > 0 {
+			cmd = append(cmd, bson.DocElem{"max", info.MaxDocs})
+		}
+	}
+	if info.DisableIdIndex {
+		cmd = append(cmd, bson.DocElem{"autoIndexId", false})
+	}
+	if info.Validator != nil {
+		cmd = append(cmd, bson.DocElem{"validator", info.Validator})
+	}
+	result := struct{}{} // We don't care, but errors must be checked.
+	return collection.DB.Run(cmd, &result)
+}
+
+// ConvertToCapped converts an existing collection into a capped
+// collection with the provided maximum size in bytes.  The oldest
+// documents are discarded if the collection data doesn't fit in
+// the new size.
+//
+// Relevant documentation:
+//
+//     http://www.mongodb.org/display/DOCS/Capped+Collections
+//
+func (collection Collection) ConvertToCapped(maxBytes int) os.Error {
+	result := struct{}{} // We don't care, but errors must be checked.
+	return collection.DB.Run(bson.D{{"convertToCapped", collection.Name}, {"size", maxBytes}}, &result)
+}
+
+// The CollectionStats type holds the details returned by the server
+// about a collection.  Sizes are in bytes.
+type CollectionStats struct {
+	Namespace      string           "ns"
+	Count          int              // Number of documents
+	Size           int64            // Total size of the documents
+	AvgObjSize     float64          "avgObjSize"
+	StorageSize    int64            "storageSize"    // Space allocated for the documents
+	NumExtents     int              "numExtents"     // Number of allocated extents
+	LastExtentSize int64            "lastExtentSize" // Size of the most recently allocated extent
+	PaddingFactor  float64          "paddingFactor"
+	NumIndexes     int              "nindexes"
+	TotalIndexSize int64            "totalIndexSize"
+	IndexSizes     map[string]int64 "indexSizes" // Size of each index, by name
+	Capped         bool
+	MaxDocs        int   "max"     // Maximum number of documents, if capped
+	MaxBytes       int64 "maxSize" // Maximum size, if capped
+}
+
+// Stats returns statistics about the collection, such as the number of
+// documents and the space used by the data and indexes.
+//
+// Relevant documentation:
+//
+//     http://www.mongodb.org/display/DOCS/Monitoring+and+Diagnostics
+//
+func (collection Collection) Stats() (stats *CollectionStats, err os.Error) {
+	stats = &CollectionStats{}
+	err = collection.DB.Run(bson.D{{"collStats", collection.Name}}, stats)
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// Rename changes the name of the collection to name, within the same
+// database.  If dropTarget is true and a collection with the new name
+// already exists, it is dropped before the rename happens.  Otherwise
+// an existing collection with the new name causes an error.
+//
+// See also the RenameTo method.
+//
+// Relevant documentation:
+//
+//     http://www.mongodb.org/display/DOCS/renameCollection+Command
+//
+func (collection Collection) Rename(name string, dropTarget bool) os.Error {
+	return collection.RenameTo(collection.DB.Name, name, dropTarget)
+}
+
+// RenameTo works like Rename, but moves the collection into the dbname
+// database.  Moving a collection across databases requires copying all
+// of its documents and indexes, so it may take a while for large
+// collections.
+//
+// Relevant documentation:
+//
+//     http://www.mongodb.org/display/DOCS/renameCollection+Command
+//
+func (collection Collection) RenameTo(dbname, name string, dropTarget bool) os.Error {
+	cmd := bson.D{
+		{"renameCollection", collection.FullName},
+		{"to", dbname + "." + name},
+		{"dropTarget", dropTarget},
+	}
+	result := struct{}{} // We don't care, but errors must be checked.
+	return collection.DB.Session.Run(cmd, &result)
+}
+
+// Compact rewrites and defragments all data and indexes of the collection,
+// releasing unused space back to the database.  The operation blocks all
+// other activity in the database while it runs.  On a replica set master,
+// force must be true for the operation to be accepted.
+//
+// Relevant documentation:
+//
+//     http://www.mongodb.org/display/DOCS/compact+Command
+//
+func (collection Collection) Compact(force bool) os.Error {
+	result := struct{}{} // We don't care, but errors must be checked.
+	return collection.DB.Run(bson.D{{"compact", collection.Name}, {"force", force}}, &result)
+}
+
+// The ValidationResult type holds the outcome of validating a collection
+// with the Validate method of Collection.
+type ValidationResult struct {
+	Namespace    string         "ns"
+	Valid        bool           // Whether the collection was found to be consistent
+	Errors       []string       // Problems found, if any
+	Warning      string         // Warning about the validation itself, if any
+	Result       string         // Free-form report from older servers
+	Records      int            "nrecords"
+	DeletedCount int            "deletedCount"
+	NumIndexes   int            "nIndexes"
+	KeysPerIndex map[string]int "keysPerIndex" // Number of keys in each index, by name
+}
+
+// Validate checks the structures of the collection and its indexes for
+// correctness.  If full is true, a more thorough and slower scan of the
+// data is performed.  Note that the returned error is only set when
+// the validation couldn't be run.  Problems found in the collection
+// itself are reported in the result.
+//
+// Relevant documentation:
+//
+//     http://www.mongodb.org/display/DOCS/Validate+Command
+//
+func (collection Collection) Validate(full bool) (result *ValidationResult, err os.Error) {
+	result = &ValidationResult{}
+	err = collection.DB.Run(bson.D{{"validate", collection.Name}, {"full", full}}, result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// The ReIndexResult type holds the outcome of the ReIndex method
+// of Collection.
+type ReIndexResult struct {
+	IndexesBefore int "nIndexesWas" // Number of indexes before rebuilding
+	IndexesAfter  int "nIndexes"    // Number of indexes after rebuilding
+}
+
+// ReIndex drops and rebuilds all indexes of the collection.  The
+// operation blocks all other activity in the database while it runs.
+//
+// Relevant documentation:
+//
+//     http://www.mongodb.org/display/DOCS/Indexes
+//
+func (collection Collection) ReIndex() (result *ReIndexResult, err os.Error) {
+	result = &ReIndexResult{}
+	err = collection.DB.Run(bson.D{{"reIndex", collection.Name}}, result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// The DatabaseStats type holds the details returned by the server
+// about a database.  Sizes are in bytes.
+type DatabaseStats struct {
+	Name        string  "db"
+	Collections int     // Number of collections
+	Objects     int     // Number of documents in all collections
+	AvgObjSize  float64 "avgObjSize"
+	DataSize    int64   "dataSize"    // Total size of the documents
+	StorageSize int64   "storageSize" // Space allocated for the documents
+	NumExtents  int     "numExtents"
+	Indexes     int     // Number of indexes in all collections
+	IndexSize   int64   "indexSize" // Total size of all indexes
+	FileSize    int64   "fileSize"  // Space allocated in data files
+	NsSizeMB    int     "nsSizeMB"  // Size of the namespace file, in megabytes
+}
+
+// Stats returns statistics about the database, such as the number of
+// collections and documents and the space used by the data and indexes.
+//
+// Relevant documentation:
+//
+//     http://www.mongodb.org/display/DOCS/Monitoring+and+Diagnostics
+//
+func (database Database) Stats() (stats *DatabaseStats, err os.Error) {
+	stats = &DatabaseStats{}
+	err = database.Run(bson.D{{"dbStats", 1}}, stats)
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
 // Batch sets the batch size used when fetching documents from the database.
 // It's possible to change this setting on a per-session basis as well, using
 // the Batch method of Session.
@@ -1372,10 +2319,18 @@ func (query *Query) Select(selector interface{}) *Query {
 }
 
 type queryWrapper struct {
-	Query   interface{} "$query"
-	OrderBy interface{} "$orderby,omitempty"
-	Hint    interface{} "$hint,omitempty"
-	Explain bool        "$explain,omitempty"
+	Query       interface{} "$query"
+	OrderBy     interface{} "$orderby,omitempty"
+	Hint        interface{} "$hint,omitempty"
+	Explain     bool        "$explain,omitempty"
+	Snapshot    bool        "$snapshot,omitempty"
+	ReturnKey   bool        "$returnKey,omitempty"
+	ShowDiskLoc bool        "$showDiskLoc,omitempty"
+	MaxScan     int         "$maxScan,omitempty"
+	Comment     string      "$comment,omitempty"
+	Min         interface{} "$min,omitempty"
+	Max         interface{} "$max,omitempty"
+	MaxTimeMS   int64       "$maxTimeMS,omitempty"
 }
 
 func (query *Query) wrap() *queryWrapper {
@@ -1463,6 +2418,179 @@ func (query *Query) Hint(indexKey []string) *Query {
 	return query
 }
 
+// HintName works like Hint, but the index to be used is identified by
+// its name rather than by its key.  Index names are usually computed
+// by EnsureIndex out of the index key (e.g. "a_1_b_-1"), and may be
+// obtained through the Indexes method of Collection.
+//
+// For example:
+//
+//     query := collection.Find(bson.M{"a": 4, "b": 5}).HintName("a_1_b_1")
+//
+// Relevant documentation:
+//
+//     http://www.mongodb.org/display/DOCS/Optimization
+//     http://www.mongodb.org/display/DOCS/Query+Optimizer
+//
+func (query *Query) HintName(indexName string) *Query {
+	query.m.Lock()
+	w := query.wrap()
+	w.Hint = indexName
+	query.m.Unlock()
+	return query
+}
+
+// Comment attaches the provided comment to the query, so that it may be
+// identified in the database profiler output and in the server logs.
+//
+// Relevant documentation:
+//
+//     http://www.mongodb.org/display/DOCS/Advanced+Queries
+//     http://www.mongodb.org/display/DOCS/Database+Profiler
+//
+func (query *Query) Comment(comment string) *Query {
+	query.m.Lock()
+	w := query.wrap()
+	w.Comment = comment
+	query.m.Unlock()
+	return query
+}
+
+// MaxScan constrains the query to stop after scanning at most n
+// documents, even if fewer than the requested number of results were
+// found by then.
+//
+// Relevant documentation:
+//
+//     http://www.mongodb.org/display/DOCS/Advanced+Queries
+//
+func (query *Query) MaxScan(n int) *Query {
+	query.m.Lock()
+	w := query.wrap()
+	w.MaxScan = n
+	query.m.Unlock()
+	return query
+}
+
+// Min restricts the query to index keys which are greater than or equal
+// to the provided bound.  The bound document must contain the fields of
+// an existing index, in the same order.  This is typically used together
+// with Max and Hint.
+//
+// For example:
+//
+//     query := collection.Find(nil).Min(bson.M{"a": 2}).Max(bson.M{"a": 5})
+//
+// Relevant documentation:
+//
+//     http://www.mongodb.org/display/DOCS/min+and+max+Query+Specifiers
+//
+func (query *Query) Min(bound interface{}) *Query {
+	query.m.Lock()
+	w := query.wrap()
+	w.Min = bound
+	query.m.Unlock()
+	return query
+}
+
+// Max restricts the query to index keys which are lower than the provided
+// bound.  See the Min method for details.
+//
+// Relevant documentation:
+//
+//     http://www.mongodb.org/display/DOCS/min+and+max+Query+Specifiers
+//
+func (query *Query) Max(bound interface{}) *Query {
+	query.m.Lock()
+	w := query.wrap()
+	w.Max = bound
+	query.m.Unlock()
+	return query
+}
+
+// Snapshot will force the performed query to make use of an available
+// index on the _id field to prevent the same document from being returned
+// more than once in a single iteration.  This might happen without this
+// setting in situations when the document changes in size and thus has to
+// be moved while the iteration is running.
+//
+// Snapshot queries can't be sorted, and aren't guaranteed to see documents
+// inserted or removed during the query.
+//
+// Relevant documentation:
+//
+//     http://www.mongodb.org/display/DOCS/How+to+do+Snapshotted+Queries+in+the+Mongo+Database
+//
+func (query *Query) Snapshot() *Query {
+	query.m.Lock()
+	w := query.wrap()
+	w.Snapshot = true
+	query.m.Unlock()
+	return query
+}
+
+// ReturnKey changes the query so that only the index key of the documents
+// found is returned, rather than the documents themselves.  If no index
+// is used by the query, empty documents will be returned.
+//
+// Relevant documentation:
+//
+//     http://www.mongodb.org/display/DOCS/Advanced+Queries
+//
+func (query *Query) ReturnKey() *Query {
+	query.m.Lock()
+	w := query.wrap()
+	w.ReturnKey = true
+	query.m.Unlock()
+	return query
+}
+
+// ShowDiskLoc adds a "$diskLoc" field to every document returned by the
+// query, informing the location of the document within the database
+// files.  This is mostly useful for debugging.
+//
+// Relevant documentation:
+//
+//     http://www.mongodb.org/display/DOCS/Advanced+Queries
+//
+func (query *Query) ShowDiskLoc() *Query {
+	query.m.Lock()
+	w := query.wrap()
+	w.ShowDiskLoc = true
+	query.m.Unlock()
+	return query
+}
+
+// SetMaxTime constrains the query to stop after running for the specified
+// time, in nanoseconds.  When the time limit is reached MongoDB automatically
+// cancels the query, and the operation in progress fails with a
+// *MaxTimeError.  The server only checks the time limit at interruption
+// points, so the operation may run for slightly longer than requested.
+// The precision used is of milliseconds.
+//
+// The limit also applies to the Count, Distinct, MapReduce and Modify
+// operations performed through the same query.
+//
+// Note that the sync timeout of the session (see the SetSyncTimeout method
+// in Session) only constrains the time spent looking for a usable server.
+//
+// This option is only supported by MongoDB 2.6+.
+//
+// Relevant documentation:
+//
+//     http://docs.mongodb.org/manual/reference/operator/meta/maxTimeMS
+//
+func (query *Query) SetMaxTime(nsec int64) *Query {
+	query.m.Lock()
+	w := query.wrap()
+	w.MaxTimeMS = nsec / 1e6
+	if w.MaxTimeMS == 0 && nsec > 0 {
+		w.MaxTimeMS = 1
+	}
+	query.m.Unlock()
+	return query
+}
+
 func checkQueryError(d []byte) os.Error {
 	found := false
 	l := len(d)
@@ -1493,10 +2621,14 @@ func checkQueryError(d []byte) os.Error {
 	if result.AssertionCode != 0 && result.Assertion != "" {
 		return &QueryError{Code: result.AssertionCode, Message: result.Assertion, Assertion: true}
 	}
-	if result.Err != "" {
-		return &QueryError{Code: result.Code, Message: result.Err}
+	msg := result.Err
+	if msg == "" {
+		msg = result.ErrMsg
+	}
+	if result.Code == maxTimeErrorCode {
+		return &MaxTimeError{Code: result.Code, Message: msg}
 	}
-	return &QueryError{Code: result.Code, Message: result.ErrMsg}
+	return &QueryError{Code: result.Code, Message: msg}
 }
 
 // One executes the query and unmarshals the first obtained document into the
@@ -1859,6 +2991,34 @@ func (iter *Iter) Next(result interface{}) (err os.Error) {
 	return
 }
 
+// Close kills the server cursor used by the iterator, if any, so that
+// the server may release it without waiting for it to time out.  This is
+// only necessary when an iteration is abandoned before reaching the end.
+// Documents already received may still be obtained with Next, but no more
+// documents are requested.
+func (iter *Iter) Close() os.Error {
+	iter.m.Lock()
+	// A reply in flight would bring the cursor back.
+	for iter.pendingDocs > 0 {
+		iter.gotReply.Wait()
+	}
+	cursorId := iter.op.cursorId
+	iter.op.cursorId = 0
+	iter.m.Unlock()
+	if cursorId == 0 {
+		return nil
+	}
+
+	socket, err := iter.session.acquireSocket(true)
+	if err != nil {
+		return err
+	}
+	defer socket.Release()
+
+	debugf("Iter %p killing cursor %d", iter, cursorId)
+	return socket.Query(&killCursorsOp{[]int64{cursorId}})
+}
+
 // The For method unmarshals into result each document found through an
 // iterator obtained from query and calls f to handle it.  The result
 // value must necessarily be a pointer to a nil reference type.
@@ -1963,8 +3123,9 @@ func (iter *Iter) getMore() {
 }
 
 type countCmd struct {
-	Count string
-	Query interface{}
+	Count     string
+	Query     interface{}
+	MaxTimeMS int64 "maxTimeMS,omitempty"
 }
 
 // Count returns the total number of documents in the result set.
@@ -1983,12 +3144,14 @@ func (query *Query) Count() (n int, err os.Error) {
 	cname := op.collection[c+1:]
 
 	q := op.query
+	var maxTime int64
 	if qw, ok := q.(*queryWrapper); ok {
 		q = qw.Query
+		maxTime = qw.MaxTimeMS
 	}
 
 	result := struct{ N int }{}
-	err = session.DB(dbname).Run(countCmd{cname, q}, &result)
+	err = session.DB(dbname).Run(countCmd{cname, q, maxTime}, &result)
 	return result.N, err
 }
 
@@ -2001,6 +3164,7 @@ type distinctCmd struct {
 	Collection string "distinct"
 	Key        string
 	Query      interface{} ",omitempty"
+	MaxTimeMS  int64       "maxTimeMS,omitempty"
 }
 
 // Distinct returns a list of distinct values for the given key within
@@ -2031,12 +3195,14 @@ func (query *Query) Distinct(key string, result interface{}) os.Error {
 	cname := op.collection[c+1:]
 
 	q := op.query
+	var maxTime int64
 	if qw, ok := q.(*queryWrapper); ok {
 		q = qw.Query
+		maxTime = qw.MaxTimeMS
 	}
 
 	var doc struct{ Values bson.Raw }
-	err := session.DB(dbname).Run(distinctCmd{cname, key, q}, &doc)
+	err := session.DB(dbname).Run(distinctCmd{cname, key, q, maxTime}, &doc)
 	if err != nil {
 		return err
 	}
@@ -2054,6 +3220,7 @@ type mapReduceCmd struct {
 	Sort       interface{} ",omitempty"
 	Scope      interface{} ",omitempty"
 	Verbose    bool        ",omitempty"
+	MaxTimeMS  int64       "maxTimeMS,omitempty"
 }
 
 type mapReduceResult struct {
@@ -2167,9 +3334,11 @@ func (query *Query) MapReduce(job MapReduce, result interface{}) (info *MapReduc
 
 	q := op.query
 	var sort interface{}
+	var maxTime int64
 	if qw, ok := q.(*queryWrapper); ok {
 		q = qw.Query
 		sort = qw.OrderBy
+		maxTime = qw.MaxTimeMS
 	}
 
 	cmd := mapReduceCmd{
@@ -2183,6 +3352,7 @@ func (query *Query) MapReduce(job MapReduce, result interface{}) (info *MapReduc
 		Query:      q,
 		Sort:       sort,
 		Limit:      limit,
+		MaxTimeMS:  maxTime,
 	}
 
 	if cmd.Out == nil {
@@ -2242,6 +3412,7 @@ type findModifyCmd struct {
 	Collection                  string      "findAndModify"
 	Query, Update, Sort, Fields interface{} ",omitempty"
 	Upsert, Remove, New         bool        ",omitempty"
+	MaxTimeMS                   int64       "maxTimeMS,omitempty"
 }
 
 type valueResult struct {
@@ -2286,9 +3457,11 @@ func (query *Query) Modify(change Change, result interface{}) (err os.Error) {
 
 	q := op.query
 	var sort interface{}
+	var maxTime int64
 	if qw, ok := q.(*queryWrapper); ok {
 		q = qw.Query
 		sort = qw.OrderBy
+		maxTime = qw.MaxTimeMS
 	}
 
 	cmd := findModifyCmd{
@@ -2300,6 +3473,7 @@ func (query *Query) Modify(change Change, result interface{}) (err os.Error) {
 		Query:      q,
 		Sort:       sort,
 		Fields:     op.selector,
+		MaxTimeMS:  maxTime,
 	}
 
 	var doc valueResult
@@ -2387,7 +3561,7 @@ func (session *Session) acquireSocket(slaveOk bool) (s *mongoSocket, err os.Erro
 
 	// Authenticate the new socket.
 	for _, a := range session.auth {
-		err = s.Login(a.db, a.user, a.pass)
+		err = s.Login(a)
 		if err != nil {
 			s.Release()
 			return nil, err
@@ -127,10 +127,6 @@ func (s *S) TestPing(c *C) {
 	c.Assert(err, IsNil)
 	defer session.Close()
 
-	// Just ensure the nonce has been received.
-	result := struct{}{}
-	err = session.Run("ping", &result)
-
 	mgo.ResetStats()
 
 	err = session.Ping()
@@ -498,6 +494,242 @@ func (s *S) TestDropCollection(c *C) {
 	c.Assert(names, Equals, []string{"system.indexes"})
 }
 
+func (s *S) TestCreateCollectionCapped(c *C) {
+	session, err := mgo.Mongo("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+
+	info := &mgo.CollectionInfo{
+		Capped:   true,
+		MaxBytes: 1024,
+		MaxDocs:  3,
+	}
+	err = coll.Create(info)
+	c.Assert(err, IsNil)
+
+	ns := []int{1, 2, 3, 4, 5}
+	for _, n := range ns {
+		err := coll.Insert(M{"n": n})
+		c.Assert(err, IsNil)
+	}
+
+	n, err := coll.Find(nil).Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 3)
+
+	stats, err := coll.Stats()
+	c.Assert(err, IsNil)
+	c.Assert(stats.Namespace, Equals, "mydb.mycoll")
+	c.Assert(stats.Count, Equals, 3)
+	c.Assert(stats.Capped, Equals, true)
+	c.Assert(stats.MaxDocs, Equals, 3)
+}
+
+func (s *S) TestCreateCollectionCappedWithoutSize(c *C) {
+	session, err := mgo.Mongo("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+
+	err = coll.Create(&mgo.CollectionInfo{Capped: true})
+	c.Assert(err, Matches, ".*MaxBytes must also be set")
+}
+
+func (s *S) TestCreateCollectionNoIndex(c *C) {
+	session, err := mgo.Mongo("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+
+	err = coll.Create(&mgo.CollectionInfo{DisableIdIndex: true})
+	c.Assert(err, IsNil)
+
+	err = coll.Insert(M{"n": 1})
+	c.Assert(err, IsNil)
+
+	indexes, err := coll.Indexes()
+	c.Assert(err, IsNil)
+	c.Assert(len(indexes), Equals, 0)
+}
+
+func (s *S) TestCreateCollectionAlreadyExists(c *C) {
+	session, err := mgo.Mongo("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+
+	err = coll.Create(&mgo.CollectionInfo{})
+	c.Assert(err, IsNil)
+
+	err = coll.Create(&mgo.CollectionInfo{})
+	c.Assert(err, Matches, "collection already exists")
+}
+
+func (s *S) TestConvertToCapped(c *C) {
+	session, err := mgo.Mongo("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+
+	err = coll.Insert(M{"n": 1})
+	c.Assert(err, IsNil)
+
+	stats, err := coll.Stats()
+	c.Assert(err, IsNil)
+	c.Assert(stats.Capped, Equals, false)
+
+	err = coll.ConvertToCapped(4096)
+	c.Assert(err, IsNil)
+
+	stats, err = coll.Stats()
+	c.Assert(err, IsNil)
+	c.Assert(stats.Capped, Equals, true)
+	c.Assert(stats.Count, Equals, 1)
+}
+
+func (s *S) TestRenameCollection(c *C) {
+	session, err := mgo.Mongo("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	db := session.DB("db1")
+	err = db.C("col1").Insert(M{"_id": 1})
+	c.Assert(err, IsNil)
+	err = db.C("col2").Insert(M{"_id": 2})
+	c.Assert(err, IsNil)
+
+	err = db.C("col1").Rename("col2", false)
+	c.Assert(err, Matches, ".*target namespace exists.*")
+
+	err = db.C("col1").Rename("col3", false)
+	c.Assert(err, IsNil)
+
+	err = db.C("col3").Rename("col2", true)
+	c.Assert(err, IsNil)
+
+	names, err := db.CollectionNames()
+	c.Assert(err, IsNil)
+	c.Assert(names, Equals, []string{"col2", "system.indexes"})
+
+	result := M{}
+	err = db.C("col2").Find(nil).One(result)
+	c.Assert(err, IsNil)
+	c.Assert(result["_id"], Equals, 1)
+}
+
+func (s *S) TestRenameCollectionToOtherDb(c *C) {
+	session, err := mgo.Mongo("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	err = session.DB("db1").C("col1").Insert(M{"_id": 1})
+	c.Assert(err, IsNil)
+
+	err = session.DB("db1").C("col1").RenameTo("db2", "col2", false)
+	c.Assert(err, IsNil)
+
+	n, err := session.DB("db1").C("col1").Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 0)
+
+	n, err = session.DB("db2").C("col2").Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 1)
+}
+
+func (s *S) TestDatabaseStats(c *C) {
+	session, err := mgo.Mongo("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	db := session.DB("db1")
+	for i := 0; i != 10; i++ {
+		err := db.C("col1").Insert(M{"n": i})
+		c.Assert(err, IsNil)
+	}
+	err = db.C("col2").Insert(M{"n": 1})
+	c.Assert(err, IsNil)
+
+	stats, err := db.Stats()
+	c.Assert(err, IsNil)
+	c.Assert(stats.Name, Equals, "db1")
+	c.Assert(stats.Collections >= 2, Equals, true)
+	c.Assert(stats.Objects >= 11, Equals, true)
+	c.Assert(stats.DataSize > 0, Equals, true)
+	c.Assert(stats.Indexes >= 2, Equals, true)
+}
+
+func (s *S) TestCollectionStats(c *C) {
+	session, err := mgo.Mongo("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+	for i := 0; i != 10; i++ {
+		err := coll.Insert(M{"n": i})
+		c.Assert(err, IsNil)
+	}
+
+	stats, err := coll.Stats()
+	c.Assert(err, IsNil)
+	c.Assert(stats.Namespace, Equals, "mydb.mycoll")
+	c.Assert(stats.Count, Equals, 10)
+	c.Assert(stats.Size > 0, Equals, true)
+	c.Assert(stats.NumIndexes, Equals, 1)
+	c.Assert(stats.IndexSizes["_id_"] > 0, Equals, true)
+	c.Assert(stats.Capped, Equals, false)
+}
+
+func (s *S) TestValidateCollection(c *C) {
+	session, err := mgo.Mongo("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+	err = coll.Insert(M{"n": 1})
+	c.Assert(err, IsNil)
+
+	result, err := coll.Validate(true)
+	c.Assert(err, IsNil)
+	c.Assert(result.Namespace, Equals, "mydb.mycoll")
+	c.Assert(result.Valid, Equals, true)
+
+	_, err = session.DB("mydb").C("unknown").Validate(false)
+	c.Assert(err, NotNil)
+}
+
+func (s *S) TestCompactAndReIndex(c *C) {
+	session, err := mgo.Mongo("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+	err = coll.EnsureIndexKey([]string{"n"})
+	c.Assert(err, IsNil)
+	for i := 0; i != 10; i++ {
+		err := coll.Insert(M{"n": i})
+		c.Assert(err, IsNil)
+	}
+
+	err = coll.Compact(false)
+	c.Assert(err, IsNil)
+
+	result, err := coll.ReIndex()
+	c.Assert(err, IsNil)
+	c.Assert(result.IndexesBefore, Equals, 2)
+	c.Assert(result.IndexesAfter, Equals, 2)
+
+	n, err := coll.Find(M{"n": M{"$gte": 5}}).Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 5)
+}
+
 func (s *S) TestFindAndModify(c *C) {
 	session, err := mgo.Mongo("localhost:40001")
 	c.Assert(err, IsNil)
@@ -639,6 +871,189 @@ func (s *S) TestQueryHint(c *C) {
 	c.Assert(m["indexBounds"].(bson.M)["a"], NotNil)
 }
 
+func (s *S) TestQueryHintName(c *C) {
+	session, err := mgo.Mongo("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+	coll.EnsureIndexKey([]string{"a"})
+
+	m := M{}
+	err = coll.Find(nil).HintName("a_1").Explain(m)
+	c.Assert(err, IsNil)
+	c.Assert(m["indexBounds"], NotNil)
+	c.Assert(m["indexBounds"].(bson.M)["a"], NotNil)
+}
+
+func (s *S) TestQueryMaxScan(c *C) {
+	session, err := mgo.Mongo("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+
+	ns := []int{40, 41, 42, 43, 44, 45, 46}
+	for _, n := range ns {
+		err := coll.Insert(M{"n": n})
+		c.Assert(err, IsNil)
+	}
+
+	var result []M
+	iter, err := coll.Find(nil).MaxScan(3).Iter()
+	c.Assert(err, IsNil)
+	for {
+		var m M
+		if iter.Next(&m) != nil {
+			break
+		}
+		result = append(result, m)
+	}
+	c.Assert(len(result), Equals, 3)
+}
+
+func (s *S) TestQueryMinMax(c *C) {
+	session, err := mgo.Mongo("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+	coll.EnsureIndexKey([]string{"n"})
+
+	ns := []int{40, 41, 42, 43, 44, 45, 46}
+	for _, n := range ns {
+		err := coll.Insert(M{"n": n})
+		c.Assert(err, IsNil)
+	}
+
+	query := coll.Find(nil).Min(M{"n": 42}).Max(M{"n": 45}).Hint([]string{"n"})
+	iter, err := query.Iter()
+	c.Assert(err, IsNil)
+
+	var result struct{ N int }
+	var found []int
+	for iter.Next(&result) == nil {
+		found = append(found, result.N)
+	}
+	c.Assert(found, Equals, []int{42, 43, 44})
+}
+
+func (s *S) TestQueryReturnKey(c *C) {
+	session, err := mgo.Mongo("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+	coll.EnsureIndexKey([]string{"a"})
+
+	err = coll.Insert(M{"a": 1, "b": 2})
+	c.Assert(err, IsNil)
+
+	result := M{}
+	err = coll.Find(M{"a": 1}).ReturnKey().One(result)
+	c.Assert(err, IsNil)
+	c.Assert(result, Equals, M{"a": 1})
+}
+
+func (s *S) TestQueryShowDiskLoc(c *C) {
+	session, err := mgo.Mongo("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+
+	err = coll.Insert(M{"a": 1})
+	c.Assert(err, IsNil)
+
+	result := M{}
+	err = coll.Find(nil).ShowDiskLoc().One(result)
+	c.Assert(err, IsNil)
+	c.Assert(result["$diskLoc"], NotNil)
+}
+
+func (s *S) TestQuerySnapshot(c *C) {
+	session, err := mgo.Mongo("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+
+	for i := 0; i != 10; i++ {
+		err := coll.Insert(M{"n": i})
+		c.Assert(err, IsNil)
+	}
+
+	n, err := coll.Find(nil).Snapshot().Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 10)
+
+	seen := 0
+	var result M
+	err = coll.Find(nil).Snapshot().For(&result, func() os.Error {
+		seen++
+		return nil
+	})
+	c.Assert(err, IsNil)
+	c.Assert(seen, Equals, 10)
+}
+
+func (s *S) TestQueryComment(c *C) {
+	session, err := mgo.Mongo("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	db := session.DB("mydb")
+	coll := db.C("mycoll")
+
+	err = db.Run(bson.M{"profile": 2}, nil)
+	c.Assert(err, IsNil)
+	defer db.Run(bson.M{"profile": 0}, nil)
+
+	err = coll.Insert(M{"n": 1})
+	c.Assert(err, IsNil)
+
+	err = coll.Find(M{"n": 1}).Comment("some comment").One(nil)
+	c.Assert(err, IsNil)
+
+	result := M{}
+	err = db.C("system.profile").Find(M{"query.$comment": "some comment"}).One(result)
+	c.Assert(err, IsNil)
+}
+
+func (s *S) TestQuerySetMaxTime(c *C) {
+	session, err := mgo.Mongo("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+
+	for i := 0; i < 1000; i++ {
+		err := coll.Insert(M{"n": i})
+		c.Assert(err, IsNil)
+	}
+
+	query := coll.Find(M{"$where": "sleep(1) || true"}).SetMaxTime(1e6)
+
+	err = query.One(nil)
+	c.Assert(err, Matches, ".*exceeded time limit.*")
+	_, ok := err.(*mgo.MaxTimeError)
+	c.Assert(ok, Equals, true)
+
+	_, err = query.Count()
+	_, ok = err.(*mgo.MaxTimeError)
+	c.Assert(ok, Equals, true)
+
+	var result []int
+	err = query.Distinct("n", &result)
+	_, ok = err.(*mgo.MaxTimeError)
+	c.Assert(ok, Equals, true)
+
+	change := mgo.Change{Update: M{"$inc": M{"n": 1}}}
+	err = query.Modify(change, &M{})
+	_, ok = err.(*mgo.MaxTimeError)
+	c.Assert(ok, Equals, true)
+}
+
 func (s *S) TestFindOneNotFound(c *C) {
 	session, err := mgo.Mongo("localhost:40001")
 	c.Assert(err, IsNil)
@@ -806,7 +1221,7 @@ func (s *S) TestFindIterLimitWithBatch(c *C) {
 		coll.Insert(M{"n": n})
 	}
 
-	// Ping the database to ensure the nonce has been received already.
+	// Ping the database to ensure the socket is established already.
 	c.Assert(session.Ping(), IsNil)
 
 	session.Refresh() // Release socket.
@@ -840,6 +1255,53 @@ func (s *S) TestFindIterLimitWithBatch(c *C) {
 	c.Assert(stats.SocketsInUse, Equals, 0)
 }
 
+func (s *S) TestFindIterClose(c *C) {
+	session, err := mgo.Mongo("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+
+	ns := []int{40, 41, 42, 43, 44, 45, 46}
+	for _, n := range ns {
+		coll.Insert(M{"n": n})
+	}
+
+	openCursors := func() int {
+		var result struct {
+			Cursors struct {
+				TotalOpen int "totalOpen"
+			}
+		}
+		err := session.Run("serverStatus", &result)
+		c.Assert(err, IsNil)
+		return result.Cursors.TotalOpen
+	}
+	before := openCursors()
+
+	iter, err := coll.Find(nil).Sort(M{"$natural": 1}).Batch(2).Prefetch(0).Iter()
+	c.Assert(err, IsNil)
+
+	result := struct{ N int }{}
+	err = iter.Next(&result)
+	c.Assert(err, IsNil)
+	c.Assert(result.N, Equals, 40)
+	c.Assert(openCursors(), Equals, before+1)
+
+	err = iter.Close()
+	c.Assert(err, IsNil)
+	c.Assert(openCursors(), Equals, before)
+
+	// Documents already received are still delivered.
+	err = iter.Next(&result)
+	c.Assert(err, IsNil)
+	c.Assert(result.N, Equals, 41)
+	err = iter.Next(&result)
+	c.Assert(err == mgo.NotFound, Equals, true)
+
+	// Closing again is harmless.
+	c.Assert(iter.Close(), IsNil)
+}
 func (s *S) TestFindIterSortWithBatch(c *C) {
 	session, err := mgo.Mongo("localhost:40001")
 	c.Assert(err, IsNil)
@@ -856,7 +1318,7 @@ func (s *S) TestFindIterSortWithBatch(c *C) {
 	// return a cursor with an in-memory sort.
 	coll.EnsureIndexKey([]string{"n"})
 
-	// Ping the database to ensure the nonce has been received already.
+	// Ping the database to ensure the socket is established already.
 	c.Assert(session.Ping(), IsNil)
 
 	session.Refresh() // Release socket.
@@ -963,12 +1425,12 @@ func (s *S) TestFindTailTimeoutWithSleep(c *C) {
 	// The following may break because it depends a bit on the internal
 	// timing used by MongoDB's AwaitData logic.  If it does, the problem
 	// will be observed as more GET_MORE_OPs than predicted:
-	// 1*QUERY for nonce + 1*GET_MORE_OP on Next + 1*GET_MORE_OP on Next after sleep +
+	// 1*GET_MORE_OP on Next + 1*GET_MORE_OP on Next after sleep +
 	// 1*INSERT_OP + 1*QUERY_OP for getLastError on insert of 47
 	stats := mgo.GetStats()
-	c.Assert(stats.SentOps, Equals, 5)
-	c.Assert(stats.ReceivedOps, Equals, 4)  // REPLY_OPs for 1*QUERY_OP for nonce + 2*GET_MORE_OPs + 1*QUERY_OP
-	c.Assert(stats.ReceivedDocs, Equals, 3) // nonce + N=47 result + getLastError response
+	c.Assert(stats.SentOps, Equals, 4)
+	c.Assert(stats.ReceivedOps, Equals, 3)  // REPLY_OPs for 2*GET_MORE_OPs + 1*QUERY_OP
+	c.Assert(stats.ReceivedDocs, Equals, 2) // N=47 result + getLastError response
 
 	c.Log("Will wait for a result which will never come...")
 
@@ -1042,12 +1504,12 @@ func (s *S) TestFindTailTimeoutNoSleep(c *C) {
 	// The following may break because it depends a bit on the internal
 	// timing used by MongoDB's AwaitData logic.  If it does, the problem
 	// will be observed as more GET_MORE_OPs than predicted:
-	// 1*QUERY_OP for nonce + 1*GET_MORE_OP on Next +
+	// 1*GET_MORE_OP on Next +
 	// 1*INSERT_OP + 1*QUERY_OP for getLastError on insert of 47
 	stats := mgo.GetStats()
-	c.Assert(stats.SentOps, Equals, 4)
-	c.Assert(stats.ReceivedOps, Equals, 3)  // REPLY_OPs for 1*QUERY_OP for nonce + 1*GET_MORE_OPs and 1*QUERY_OP
-	c.Assert(stats.ReceivedDocs, Equals, 3) // nonce + N=47 result + getLastError response
+	c.Assert(stats.SentOps, Equals, 3)
+	c.Assert(stats.ReceivedOps, Equals, 2)  // REPLY_OPs for 1*GET_MORE_OP and 1*QUERY_OP
+	c.Assert(stats.ReceivedDocs, Equals, 2) // N=47 result + getLastError response
 
 	c.Log("Will wait for a result which will never come...")
 
@@ -1121,12 +1583,12 @@ func (s *S) TestFindTailNoTimeout(c *C) {
 	// The following may break because it depends a bit on the internal
 	// timing used by MongoDB's AwaitData logic.  If it does, the problem
 	// will be observed as more GET_MORE_OPs than predicted:
-	// 1*QUERY_OP for nonce + 1*GET_MORE_OP on Next +
+	// 1*GET_MORE_OP on Next +
 	// 1*INSERT_OP + 1*QUERY_OP for getLastError on insert of 47
 	stats := mgo.GetStats()
-	c.Assert(stats.SentOps, Equals, 4)
-	c.Assert(stats.ReceivedOps, Equals, 3)  // REPLY_OPs for 1*QUERY_OP for nonce + 1*GET_MORE_OPs and 1*QUERY_OP
-	c.Assert(stats.ReceivedDocs, Equals, 3) // nonce + N=47 result + getLastError response
+	c.Assert(stats.SentOps, Equals, 3)
+	c.Assert(stats.ReceivedOps, Equals, 2)  // REPLY_OPs for 1*GET_MORE_OP and 1*QUERY_OP
+	c.Assert(stats.ReceivedDocs, Equals, 2) // N=47 result + getLastError response
 
 	c.Log("Will wait for a result which will never come...")
 
@@ -1882,6 +2344,148 @@ func (s *S) TestEnsureIndexGetIndexes(c *C) {
 	c.Assert(indexes[3].Key, Equals, []string{"@c"})
 }
 
+func (s *S) TestEnsureIndexExpireAfter(c *C) {
+	session, err := mgo.Mongo("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+
+	index := mgo.Index{
+		Key:         []string{"t"},
+		ExpireAfter: 60e9,
+	}
+	err = coll.EnsureIndex(index)
+	c.Assert(err, IsNil)
+
+	result := M{}
+	err = session.DB("mydb").C("system.indexes").Find(M{"name": "t_1"}).One(result)
+	c.Assert(err, IsNil)
+	c.Assert(result["expireAfterSeconds"], Equals, 60)
+
+	indexes, err := coll.Indexes()
+	c.Assert(err, IsNil)
+	c.Assert(indexes[1].Name, Equals, "t_1")
+	c.Assert(indexes[1].ExpireAfter, Equals, int64(60e9))
+}
+
+func (s *S) TestEnsureIndexNameAndPartialFilter(c *C) {
+	session, err := mgo.Mongo("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+
+	index := mgo.Index{
+		Key:           []string{"a", "-b"},
+		Name:          "myindex",
+		PartialFilter: bson.M{"b": bson.M{"$gt": 10}},
+	}
+	err = coll.EnsureIndex(index)
+	c.Assert(err, IsNil)
+
+	indexes, err := coll.Indexes()
+	c.Assert(err, IsNil)
+	c.Assert(indexes[1].Name, Equals, "myindex")
+	c.Assert(indexes[1].Key, Equals, []string{"a", "-b"})
+	c.Assert(indexes[1].PartialFilter, Equals, bson.M{"b": bson.M{"$gt": 10}})
+
+	err = coll.DropIndexName("myindex")
+	c.Assert(err, IsNil)
+
+	indexes, err = coll.Indexes()
+	c.Assert(err, IsNil)
+	c.Assert(len(indexes), Equals, 1)
+}
+
+func (s *S) TestEnsureIndexCollation(c *C) {
+	session, err := mgo.Mongo("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+
+	index := mgo.Index{
+		Key:       []string{"a"},
+		Collation: &mgo.Collation{Locale: "en", Strength: 2},
+	}
+	err = coll.EnsureIndex(index)
+	c.Assert(err, IsNil)
+
+	indexes, err := coll.Indexes()
+	c.Assert(err, IsNil)
+	c.Assert(indexes[1].Collation, NotNil)
+	c.Assert(indexes[1].Collation.Locale, Equals, "en")
+	c.Assert(indexes[1].Collation.Strength, Equals, 2)
+}
+
+func (s *S) TestEnsureIndexText(c *C) {
+	session, err := mgo.Mongo("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+
+	index := mgo.Index{
+		Key:             []string{"cat", "$text:body", "$text:title"},
+		Weights:         map[string]int{"title": 10, "body": 1},
+		DefaultLanguage: "portuguese",
+	}
+	err = coll.EnsureIndex(index)
+	c.Assert(err, IsNil)
+
+	indexes, err := coll.Indexes()
+	c.Assert(err, IsNil)
+	c.Assert(indexes[1].Name, Equals, "cat_1_body_text_title_text")
+	c.Assert(indexes[1].Key, Equals, []string{"cat", "$text:body", "$text:title"})
+	c.Assert(indexes[1].Weights, Equals, map[string]int{"title": 10, "body": 1})
+	c.Assert(indexes[1].DefaultLanguage, Equals, "portuguese")
+
+	// Weights are reported for all text fields, as the server has them.
+	coll = session.DB("mydb").C("othercoll")
+	err = coll.EnsureIndexKey([]string{"$text:title"})
+	c.Assert(err, IsNil)
+
+	indexes, err = coll.Indexes()
+	c.Assert(err, IsNil)
+	c.Assert(indexes[1].Key, Equals, []string{"$text:title"})
+	c.Assert(indexes[1].Weights, Equals, map[string]int{"title": 1})
+}
+
+func (s *S) TestEnsureIndex2dsphereAndHashed(c *C) {
+	session, err := mgo.Mongo("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+
+	err = coll.EnsureIndexKey([]string{"$2dsphere:loc"})
+	c.Assert(err, IsNil)
+
+	err = coll.EnsureIndexKey([]string{"$hashed:h"})
+	c.Assert(err, IsNil)
+
+	sysidx := session.DB("mydb").C("system.indexes")
+
+	result := M{}
+	err = sysidx.Find(M{"name": "loc_2dsphere"}).One(result)
+	c.Assert(err, IsNil)
+	c.Assert(result["key"], Equals, bson.M{"loc": "2dsphere"})
+
+	result = M{}
+	err = sysidx.Find(M{"name": "h_hashed"}).One(result)
+	c.Assert(err, IsNil)
+	c.Assert(result["key"], Equals, bson.M{"h": "hashed"})
+
+	indexes, err := coll.Indexes()
+	c.Assert(err, IsNil)
+	c.Assert(indexes[1].Key, Equals, []string{"$hashed:h"})
+	c.Assert(indexes[2].Key, Equals, []string{"$2dsphere:loc"})
+
+	err = coll.EnsureIndexKey([]string{"$unknown:x"})
+	c.Assert(err, Matches, "Invalid index key kind: unknown")
+}
+
 func (s *S) TestDistinct(c *C) {
 	session, err := mgo.Mongo("localhost:40001")
 	c.Assert(err, IsNil)
@@ -2122,6 +2726,31 @@ func (s *S) TestMapReduceLimit(c *C) {
 	c.Assert(len(result), Equals, 3)
 }
 
+func (s *S) TestMapReduceMaxTime(c *C) {
+	session, err := mgo.Mongo("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+
+	for i := 0; i < 1000; i++ {
+		err := coll.Insert(M{"n": i})
+		c.Assert(err, IsNil)
+	}
+
+	job := mgo.MapReduce{
+		Map:    "function() { sleep(1); emit(this.n, 1); }",
+		Reduce: "function(key, values) { return Array.sum(values); }",
+	}
+
+	var result []bson.M
+	_, err = coll.Find(nil).SetMaxTime(1e6).MapReduce(job, &result)
+	c.Assert(err, Matches, ".*exceeded time limit.*")
+	merr, ok := err.(*mgo.MaxTimeError)
+	c.Assert(ok, Equals, true)
+	c.Assert(merr.Code, Equals, 50)
+}
+
 func (s *S) TestBuildInfo(c *C) {
 	session, err := mgo.Mongo("localhost:40001")
 	c.Assert(err, IsNil)
@@ -43,14 +43,17 @@ type replyFunc func(err os.Error, reply *replyOp, docNum int, docData []byte)
 type mongoSocket struct {
 	sync.Mutex
 	server        *mongoServer // nil when cached
-	conn          *net.TCPConn
+	conn          net.Conn
 	addr          string // For debugging only.
+	certSubject   string // Subject of the TLS client certificate, if any.
 	nextRequestId uint32
 	replyFuncs    map[uint32]replyFunc
 	references    int
 	auth          []authInfo
 	logout        []authInfo
-	cachedNonce   string
+	nonceState    int
+	nonce         string
+	nonceErr      os.Error
 	gotNonce      sync.Cond
 	dead          os.Error
 }
@@ -97,19 +100,22 @@ type deleteOp struct {
 	flags      uint32
 }
 
+type killCursorsOp struct {
+	cursorIds []int64
+}
+
 type requestInfo struct {
 	bufferPos int
 	replyFunc replyFunc
 }
 
-func newSocket(server *mongoServer, conn *net.TCPConn) *mongoSocket {
-	socket := &mongoSocket{conn: conn, addr: server.Addr}
+func newSocket(server *mongoServer, conn net.Conn) *mongoSocket {
+	socket := &mongoSocket{conn: conn, addr: server.Addr, certSubject: server.certSubject}
 	socket.gotNonce.L = &socket.Mutex
 	socket.replyFuncs = make(map[uint32]replyFunc)
 	socket.Acquired(server)
 	stats.socketsAlive(+1)
 	debugf("Socket %p to %s: initialized", socket, socket.addr)
-	socket.resetNonce()
 	go socket.readLoop()
 	return socket
 }
@@ -190,6 +196,7 @@ func (socket *mongoSocket) kill(err os.Error) {
 	stats.socketsAlive(-1)
 	replyFuncs := socket.replyFuncs
 	socket.replyFuncs = make(map[uint32]replyFunc)
+	socket.gotNonce.Broadcast()
 	socket.Unlock()
 	for _, f := range replyFuncs {
 		logf("Socket %p to %s: notifying replyFunc of closed socket: %s", socket, socket.addr, err.String())
@@ -304,6 +311,14 @@ func (socket *mongoSocket) Query(ops ...interface{}) (err os.Error) {
 				return err
 			}
 
+		case *killCursorsOp:
+			buf = addHeader(buf, 2007)
+			buf = addInt32(buf, 0) // Reserved
+			buf = addInt32(buf, int32(len(op.cursorIds)))
+			for _, cursorId := range op.cursorIds {
+				buf = addInt64(buf, cursorId)
+			}
+
 		default:
 			panic("Internal error: unknown operation type")
 		}
@@ -356,7 +371,7 @@ func (socket *mongoSocket) Query(ops ...interface{}) (err os.Error) {
 	return err
 }
 
-func fill(r *net.TCPConn, b []byte) os.Error {
+func fill(r net.Conn, b []byte) os.Error {
 	l := len(b)
 	n, err := r.Read(b)
 	for n != l && err == nil {
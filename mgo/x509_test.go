@@ -0,0 +1,108 @@
+// mgo - MongoDB driver for Go
+// 
+// Copyright (c) 2010-2011 - Gustavo Niemeyer <gustavo@niemeyer.net>
+// 
+// All rights reserved.
+// 
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// 
+//     * Redistributions of source code must retain the above copyright notice,
+//       this list of conditions and the following disclaimer.
+//     * Redistributions in binary form must reproduce the above copyright notice,
+//       this list of conditions and the following disclaimer in the documentation
+//       and/or other materials provided with the distribution.
+//     * Neither the name of the copyright holder nor the names of its
+//       contributors may be used to endorse or promote products derived from
+//       this software without specific prior written permission.
+// 
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package mgo
+
+import (
+	"crypto/tls"
+	"encoding/pem"
+	"launchpad.net/gocheck"
+)
+
+// Subject: CN=client\, one,OU=KernelUser,O=MongoDB,L=New York City,ST=New York,C=US
+var x509TestCert = []byte(`-----BEGIN CERTIFICATE-----
+MIICxjCCAi+gAwIBAgIUKOEvegiYvHMcmWZKa+VPg3jJVUcwDQYJKoZIhvcNAQEL
+BQAwdTELMAkGA1UEBhMCVVMxETAPBgNVBAgMCE5ldyBZb3JrMRYwFAYDVQQHDA1O
+ZXcgWW9yayBDaXR5MRAwDgYDVQQKDAdNb25nb0RCMRMwEQYDVQQLDApLZXJuZWxV
+c2VyMRQwEgYDVQQDDAtjbGllbnQsIG9uZTAeFw0yNjEwMTgyMDQ4NDZaFw0zNjEw
+MTUyMDQ4NDZaMHUxCzAJBgNVBAYTAlVTMREwDwYDVQQIDAhOZXcgWW9yazEWMBQG
+A1UEBwwNTmV3IFlvcmsgQ2l0eTEQMA4GA1UECgwHTW9uZ29EQjETMBEGA1UECwwK
+S2VybmVsVXNlcjEUMBIGA1UEAwwLY2xpZW50LCBvbmUwgZ8wDQYJKoZIhvcNAQEB
+BQADgY0AMIGJAoGBAPafDEJievcnZ+e0+mg2OmRy6MBwBWiEQLPFY3sUa/zJ4Zy5
+uAsMjy2Whiir3RWHDIlErUhHmyQRmRZIbO9c3t0faLSvruBuj88xYErVJ6QeGics
+LYm8VhxIIVFQpy2cNJh3xYLnRRCSXOvQkIPw4R+omPOWc2ZC3wueiU1XsDHvAgMB
+AAGjUzBRMB0GA1UdDgQWBBQJw/baYBDrTcsTwLkwsvl6Up1jVTAfBgNVHSMEGDAW
+gBQJw/baYBDrTcsTwLkwsvl6Up1jVTAPBgNVHRMBAf8EBTADAQH/MA0GCSqGSIb3
+DQEBCwUAA4GBAI96iA3aZ+w+YN4/FTPg1+BGiNhL6DARwOg3WgFtX9DmMK5MlTQp
+0VULHwtz+1TYlxiN/a8Nyw0JcZQiUxO8zVlE5lo+Rndcy/yIokPm6VRve2vfCRhw
+BGvHqObYZek2/U3LF2GHDJil2FE2XIVZ1odWLq0DlMK9gZkGeLuqQPpo
+-----END CERTIFICATE-----
+`)
+
+func (s *SS) TestCertificateSubject(c *gocheck.C) {
+	block, _ := pem.Decode(x509TestCert)
+	c.Assert(block, gocheck.NotNil)
+	cert := tls.Certificate{Certificate: [][]byte{block.Bytes}}
+	subject, err := certificateSubject(cert)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(subject, gocheck.Equals, `CN=client\, one,OU=KernelUser,O=MongoDB,L=New York City,ST=New York,C=US`)
+}
+
+// Subject: CN=client\, one,UID=u1+OU=Kernel,O=MongoDB,DC=example,DC=org
+var x509MultiValuedCert = []byte(`-----BEGIN CERTIFICATE-----
+MIICzjCCAjegAwIBAgIUBUtZHb8NZFjyMZdwnIe3QPOeX9swDQYJKoZIhvcNAQEL
+BQAweTETMBEGCgmSJomT8ixkARkWA29yZzEXMBUGCgmSJomT8ixkARkWB2V4YW1w
+bGUxEDAOBgNVBAoMB01vbmdvREIxITANBgNVBAsMBktlcm5lbDAQBgoJkiaJk/Is
+ZAEBDAJ1MTEUMBIGA1UEAwwLY2xpZW50LCBvbmUwHhcNMjYxMDE4MjExODIxWhcN
+MzYxMDE1MjExODIxWjB5MRMwEQYKCZImiZPyLGQBGRYDb3JnMRcwFQYKCZImiZPy
+LGQBGRYHZXhhbXBsZTEQMA4GA1UECgwHTW9uZ29EQjEhMA0GA1UECwwGS2VybmVs
+MBAGCgmSJomT8ixkAQEMAnUxMRQwEgYDVQQDDAtjbGllbnQsIG9uZTCBnzANBgkq
+hkiG9w0BAQEFAAOBjQAwgYkCgYEAw89V3o0oC0omX42GSizWzNKpHe9K33pJwrvl
+OdIZO0BTNNB4BPyoSDjtd3bwh1AcyroGR+fjoLJQstl7NkVQMpraEI67H1jrY4gT
+sGH+6S9/Q+xG32eYlZlY6xiRopfniXv6DuJtyrWVsB/X446Sjbvba1O+toatPIU2
+YGobao8CAwEAAaNTMFEwHQYDVR0OBBYEFKeLqE8l7B//xdVIG7tJmvvMIFyaMB8G
+A1UdIwQYMBaAFKeLqE8l7B//xdVIG7tJmvvMIFyaMA8GA1UdEwEB/wQFMAMBAf8w
+DQYJKoZIhvcNAQELBQADgYEAr8HfiKQScI+nJJY4ZUzLV5cqSL1OuL9uVKiHopPa
+3/BB3GgGNaw9/xn/GG/gHCA1PMx6XUxK44njNP+TOF/UmkJPhbru/FMB5ayTOBE2
+ORZ5NUFF7o864BeigRvptxKM5CG3GIt5naRs7kxeOVivVhL4Lqm/DU30m4la/Lke
+9AA=
+-----END CERTIFICATE-----
+`)
+
+func (s *SS) TestCertificateSubjectMultiValued(c *gocheck.C) {
+	block, _ := pem.Decode(x509MultiValuedCert)
+	c.Assert(block, gocheck.NotNil)
+	cert := tls.Certificate{Certificate: [][]byte{block.Bytes}}
+	subject, err := certificateSubject(cert)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(subject, gocheck.Equals, `CN=client\, one,UID=u1+OU=Kernel,O=MongoDB,DC=example,DC=org`)
+}
+
+func (s *SS) TestCertificateSubjectEmpty(c *gocheck.C) {
+	_, err := certificateSubject(tls.Certificate{})
+	c.Assert(err, gocheck.Matches, "TLS certificate is empty")
+}
+
+func (s *SS) TestEscapeDN(c *gocheck.C) {
+	c.Assert(escapeDN("plain"), gocheck.Equals, "plain")
+	c.Assert(escapeDN(`a,b+c"d\e<f>g;h`), gocheck.Equals, `a\,b\+c\"d\\e\<f\>g\;h`)
+	c.Assert(escapeDN("#x"), gocheck.Equals, `\#x`)
+	c.Assert(escapeDN(" x "), gocheck.Equals, `\ x\ `)
+}